@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+//go:embed template page static email locale
+var embeddedFS embed.FS
+
+// assetFS is where templates and static files are read from: the copy built
+// into the binary, or the working directory in dev mode.
+var assetFS fs.FS = embeddedFS
+
+// templatesMu guards tmpl, pageTmpl, emailTmpl and catalogs, which are
+// replaced whenever the templates are reloaded in dev mode.
+var templatesMu sync.RWMutex
+
+// loadTemplates parses every template in assetFS once per locale, each
+// with its own "t" func, and swaps them in along with the message catalogs.
+// On error the current templates are kept.
+func loadTemplates() error {
+	cats, err := parseCatalogs(assetFS)
+	if err != nil {
+		return err
+	}
+
+	files, err := fs.ReadDir(assetFS, "page")
+	if err != nil {
+		return err
+	}
+
+	bases := map[string]*template.Template{}
+	pages := map[string]map[string]*template.Template{}
+	for _, locale := range siteLocales {
+		base, err := template.New("base").Funcs(sprig.FuncMap()).Funcs(template.FuncMap{
+			"asset":       assetURL,
+			"vendor":      vendorAsset,
+			"importMap":   importMap,
+			"siteLocales": func() []string { return siteLocales },
+			"t":           translator(cats, locale),
+		}).ParseFS(assetFS, "template/*.tmpl")
+		if err != nil {
+			return err
+		}
+
+		bases[locale], pages[locale] = base, map[string]*template.Template{}
+		for _, file := range files {
+			clone, err := base.Clone()
+			if err != nil {
+				return err
+			}
+			if pages[locale][file.Name()], err = clone.ParseFS(assetFS, "page/"+file.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	emails, err := parseEmailTemplates(assetFS)
+	if err != nil {
+		return err
+	}
+
+	templatesMu.Lock()
+	tmpl, pageTmpl, emailTmpl, catalogs = bases, pages, emails, cats
+	templatesMu.Unlock()
+
+	return nil
+}
+
+// watchAssets reloads the static files and templates whenever a file under
+// static/, template/, page/, email/ or locale/ changes. It polls, as the
+// files are few and this only runs in dev mode.
+func watchAssets(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := assetsVersion()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		version := assetsVersion()
+		if version == last {
+			continue
+		}
+		last = version
+
+		if err := loadStaticAssets(); err != nil {
+			slog.ErrorContext(ctx, "reload static assets failed", "err", err)
+			continue
+		}
+		if err := loadTemplates(); err != nil {
+			slog.ErrorContext(ctx, "reload templates failed", "err", err)
+			continue
+		}
+		slog.InfoContext(ctx, "reloaded assets")
+	}
+}
+
+// assetsVersion sums up the names and modification times of the watched
+// files, so adding, removing or editing one changes it.
+func assetsVersion() string {
+	version := ""
+	for _, dir := range []string{"static", "template", "page", "email", "locale"} {
+		fs.WalkDir(assetFS, dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				version += path + info.ModTime().String() + "\n"
+			}
+			return nil
+		})
+	}
+	return version
+}
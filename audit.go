@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// authEventRetention is how long auth_events are kept.
+const authEventRetention = 180 * 24 * time.Hour
+
+// Events recorded in auth_events. The account page labels each one with
+// the message "event.<event>".
+const (
+	authEventSignUpRequested      = "sign-up-requested"
+	authEventSignUp               = "sign-up"
+	authEventCodeSent             = "code-sent"
+	authEventCodeVerified         = "code-verified"
+	authEventCodeFailed           = "code-failed"
+	authEventLogIn                = "log-in"
+	authEventLogInFailed          = "log-in-failed"
+	authEventLogOut               = "log-out"
+	authEventSessionRevoked       = "session-revoked"
+	authEventAllSessionsRevoked   = "all-sessions-revoked"
+	authEventPasskeyAdded         = "passkey-added"
+	authEventPasskeyRemoved       = "passkey-removed"
+	authEventIdentityLinked       = "identity-linked"
+	authEventUsernameChanged      = "username-changed"
+	authEventEmailChangeRequested = "email-change-requested"
+	authEventEmailChanged         = "email-changed"
+	authEventAccountDeleted       = "account-deleted"
+)
+
+// authEvents lists every event, for filtering.
+var authEvents = []string{
+	authEventSignUpRequested,
+	authEventSignUp,
+	authEventCodeSent,
+	authEventCodeVerified,
+	authEventCodeFailed,
+	authEventLogIn,
+	authEventLogInFailed,
+	authEventLogOut,
+	authEventSessionRevoked,
+	authEventAllSessionsRevoked,
+	authEventPasskeyAdded,
+	authEventPasskeyRemoved,
+	authEventIdentityLinked,
+	authEventUsernameChanged,
+	authEventEmailChangeRequested,
+	authEventEmailChanged,
+	authEventAccountDeleted,
+}
+
+type AuthEvent struct {
+	ID        int64
+	Username  string
+	Email     string
+	Event     string
+	Detail    string
+	IP        string
+	UserAgent string
+	CreatedAt string
+}
+
+// AuthEventFilter narrows listAuthEvents. Empty fields match everything.
+type AuthEventFilter struct {
+	Username string
+	Email    string
+	Event    string
+	IP       string
+	Limit    int
+}
+
+// recordAuthEvent writes event to auth_events along with the client of r.
+// Failures are only logged, so auditing never blocks logging in.
+func recordAuthEvent(r *http.Request, event string, username string, email string, detail string) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+
+	if _, err := db.ExecContext(context.WithoutCancel(r.Context()), `
+		INSERT INTO auth_events (username, email, event, detail, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, nullString(username), nullString(email), event, detail, clientIP(r), userAgent); err != nil {
+		slog.ErrorContext(r.Context(), "record auth event failed", "event", event, "err", err)
+	}
+}
+
+// recordCodeFailure records a wrong, expired or locked out email code for
+// purpose. Other errors aren't the user's doing and are left out.
+func recordCodeFailure(r *http.Request, purpose string, username string, email string, err error) {
+	var reason string
+	switch {
+	case errors.Is(err, errEmailCodeInvalid):
+		reason = "invalid"
+	case errors.Is(err, errEmailCodeExpired):
+		reason = "expired"
+	case errors.Is(err, errEmailCodeLocked):
+		reason = "locked"
+	default:
+		return
+	}
+
+	recordAuthEvent(r, authEventCodeFailed, username, email, purpose+": "+reason)
+}
+
+func listAuthEvents(ctx context.Context, filter AuthEventFilter) ([]AuthEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(username, ''), COALESCE(email, ''), event, detail, ip, user_agent, created_at
+		FROM auth_events
+		WHERE (?1 = '' OR username = ?1)
+		AND (?2 = '' OR email = ?2)
+		AND (?3 = '' OR event = ?3)
+		AND (?4 = '' OR ip = ?4)
+		ORDER BY id DESC
+		LIMIT ?5
+	`, filter.Username, filter.Email, filter.Event, filter.IP, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuthEvent{}
+	for rows.Next() {
+		e := AuthEvent{}
+		if err := rows.Scan(&e.ID, &e.Username, &e.Email, &e.Event, &e.Detail, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
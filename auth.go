@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+type userContextKey struct{}
+
+// requestUser holds the logged in user of one request, see withUser.
+type requestUser struct {
+	once sync.Once
+	user *User
+	err  error
+}
+
+// withUser gives each request a slot for its logged in user. The user is
+// looked up the first time currentUser is called and reused after that, so
+// requests for static files don't touch the database.
+func withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), userContextKey{}, &requestUser{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// currentUser returns the user logged in on r, or nil if there is none.
+func currentUser(r *http.Request) (*User, error) {
+	ru, ok := r.Context().Value(userContextKey{}).(*requestUser)
+	if !ok {
+		panic("currentUser: request didn't go through withUser")
+	}
+
+	ru.once.Do(func() {
+		u, ok, err := getSessionUser(r)
+		if err != nil || !ok {
+			ru.err = err
+			return
+		}
+
+		if u.Roles, err = getUserRoles(r.Context(), u.Username); err != nil {
+			ru.err = err
+			return
+		}
+		ru.user = u
+	})
+
+	return ru.user, ru.err
+}
+
+func getUserRoles(ctx context.Context, username string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT role FROM user_roles WHERE username = ? ORDER BY role", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// grantRole gives role to each of usernames that exists.
+func grantRole(ctx context.Context, role string, usernames []string) error {
+	for _, username := range usernames {
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO user_roles (username, role)
+			SELECT username, ? FROM users WHERE username = ?
+			ON CONFLICT DO NOTHING
+		`, role, username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *User) HasRole(role string) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+// RequireUser only calls next for logged in users. Anyone else is sent to
+// the log in page when loading a page, or gets a 401.
+func RequireUser(next func(w http.ResponseWriter, r *http.Request, u *User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := currentUser(r)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		} else if u == nil {
+			if r.Method == http.MethodGet && r.Header.Get("HX-Request") == "" {
+				http.Redirect(w, r, "/log-in/", http.StatusFound)
+				return
+			}
+			writeError(w, r, http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r, u)
+	}
+}
+
+// RequireRole is RequireUser for users with role. Logged in users without
+// it get a 403.
+func RequireRole(role string, next func(w http.ResponseWriter, r *http.Request, u *User)) http.HandlerFunc {
+	return RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		if !u.HasRole(role) {
+			writeError(w, r, http.StatusForbidden)
+			return
+		}
+
+		next(w, r, u)
+	})
+}
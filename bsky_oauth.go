@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+var errBskyAccountNotFound = errors.New("bluesky account not found")
+
+// BskyOAuthClient implements the client side of AT Protocol OAuth: PAR,
+// PKCE and DPoP-bound token requests against the account's authorization
+// server. Directory and HTTPClient can be swapped to point at a local PDS.
+type BskyOAuthClient struct {
+	ClientURI   string
+	ClientID    string
+	RedirectURI string
+	Scope       string
+	Directory   identity.Directory
+	HTTPClient  *http.Client
+	// AllowPrivate lets servers be plain HTTP or on private addresses, for
+	// a local PDS. Otherwise users could point us at internal hosts.
+	AllowPrivate bool
+}
+
+type BskyAuthServerMetadata struct {
+	Issuer                             string   `json:"issuer"`
+	AuthorizationEndpoint              string   `json:"authorization_endpoint"`
+	TokenEndpoint                      string   `json:"token_endpoint"`
+	PushedAuthorizationRequestEndpoint string   `json:"pushed_authorization_request_endpoint"`
+	DPoPSigningAlgValuesSupported      []string `json:"dpop_signing_alg_values_supported"`
+}
+
+type BskyTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	Sub         string `json:"sub"`
+}
+
+func newBskyOAuthClient(publicURL string, plcURL string, allowPrivate bool) *BskyOAuthClient {
+	redirectURI := publicURL + "/bsky-oauth-callback/"
+	scope := "atproto"
+
+	clientID := publicURL + "/oauth-client-metadata.json"
+	if u, err := url.Parse(publicURL); err == nil && u.Scheme == "http" {
+		// Loopback development clients have no metadata document, see
+		// https://atproto.com/specs/oauth#localhost-client-development
+		redirectURI = strings.Replace(redirectURI, "localhost", "127.0.0.1", 1)
+		clientID = "http://localhost?" + url.Values{
+			"redirect_uri": {redirectURI},
+			"scope":        {scope},
+		}.Encode()
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		httpClient = publicHTTPClient(10 * time.Second)
+	}
+
+	// did:web documents and handles are fetched from hosts users pick too.
+	var directory identity.Directory
+	if plcURL != "" {
+		directory = &identity.BaseDirectory{
+			PLCURL:     plcURL,
+			HTTPClient: *httpClient,
+		}
+	} else {
+		cached := identity.NewCacheDirectory(&identity.BaseDirectory{
+			PLCURL:                identity.DefaultPLCURL,
+			HTTPClient:            *httpClient,
+			TryAuthoritativeDNS:   true,
+			SkipDNSDomainSuffixes: []string{".bsky.social"},
+		}, 250_000, 24*time.Hour, 2*time.Minute, 5*time.Minute)
+		directory = &cached
+	}
+
+	return &BskyOAuthClient{
+		ClientURI:    publicURL,
+		ClientID:     clientID,
+		RedirectURI:  redirectURI,
+		Scope:        scope,
+		Directory:    directory,
+		HTTPClient:   httpClient,
+		AllowPrivate: allowPrivate,
+	}
+}
+
+// publicHTTPClient returns a client that refuses to connect to loopback,
+// private and link-local addresses. The check runs on the address dialed,
+// after DNS resolution, so a public name resolving to an internal address
+// is refused too.
+func publicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(ip) {
+				return fmt.Errorf("%s is not a public address", ip)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the host, skipping the check.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// checkServerURL refuses URLs of servers we shouldn't talk to: anything
+// but https, unless AllowPrivate is set.
+func (c *BskyOAuthClient) checkServerURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" && !(c.AllowPrivate && parsed.Scheme == "http") {
+		return fmt.Errorf("%s is not an https URL", u)
+	}
+	return nil
+}
+
+func (c *BskyOAuthClient) ClientMetadata() map[string]any {
+	return map[string]any{
+		"client_id":                  c.ClientID,
+		"client_name":                "台島",
+		"client_uri":                 c.ClientURI,
+		"application_type":           "web",
+		"grant_types":                []string{"authorization_code"},
+		"response_types":             []string{"code"},
+		"redirect_uris":              []string{c.RedirectURI},
+		"scope":                      c.Scope,
+		"token_endpoint_auth_method": "none",
+		"dpop_bound_access_tokens":   true,
+	}
+}
+
+// StartAuthorization resolves input, which may be a handle, a DID or a
+// PDS/entryway URL, pushes an authorization request and returns the URL
+// the browser should be sent to along with the request's state, which
+// must be bound to the browser with setBskyStateCookie. The request is
+// stored in bsky_oauth_requests until the callback consumes it.
+func (c *BskyOAuthClient) StartAuthorization(ctx context.Context, input string, linkUsername string) (string, string, error) {
+	input = strings.TrimPrefix(strings.TrimSpace(input), "@")
+
+	var did, loginHint, serverURL string
+	if strings.HasPrefix(input, "https://") || strings.HasPrefix(input, "http://") {
+		if err := c.checkServerURL(input); err != nil {
+			return "", "", errBskyAccountNotFound
+		}
+		serverURL = strings.TrimSuffix(input, "/")
+	} else {
+		atid, err := syntax.ParseAtIdentifier(input)
+		if err != nil {
+			return "", "", errBskyAccountNotFound
+		}
+
+		ident, err := c.Directory.Lookup(ctx, *atid)
+		if err != nil {
+			slog.WarnContext(ctx, "resolve bsky identity failed", "input", input, "err", err)
+			return "", "", errBskyAccountNotFound
+		}
+
+		did = ident.DID.String()
+		loginHint = input
+		serverURL = ident.PDSEndpoint()
+		if serverURL == "" {
+			return "", "", errBskyAccountNotFound
+		}
+	}
+
+	meta, err := c.resolveAuthServer(ctx, serverURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	dpopKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	dpopKeyDER, err := x509.MarshalPKCS8PrivateKey(dpopKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	state := randomToken(24)
+	verifier := randomToken(48)
+	challenge := sha256.Sum256([]byte(verifier))
+
+	form := url.Values{
+		"client_id":             {c.ClientID},
+		"response_type":         {"code"},
+		"redirect_uri":          {c.RedirectURI},
+		"scope":                 {c.Scope},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if loginHint != "" {
+		form.Set("login_hint", loginHint)
+	}
+
+	var par struct {
+		RequestURI string `json:"request_uri"`
+	}
+	nonce, err := c.postDPoP(ctx, meta.PushedAuthorizationRequestEndpoint, form, dpopKey, "", &par)
+	if err != nil {
+		return "", "", err
+	}
+	if par.RequestURI == "" {
+		return "", "", errors.New("authorization server returned no request_uri")
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO bsky_oauth_requests (state, link_username, did, issuer, token_endpoint, pkce_verifier, dpop_key, dpop_nonce)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, state, nullString(linkUsername), nullString(did), meta.Issuer, meta.TokenEndpoint, verifier, base64.StdEncoding.EncodeToString(dpopKeyDER), nonce); err != nil {
+		return "", "", err
+	}
+
+	return meta.AuthorizationEndpoint + "?" + url.Values{
+		"client_id":   {c.ClientID},
+		"request_uri": {par.RequestURI},
+	}.Encode(), state, nil
+}
+
+type BskyOAuthResult struct {
+	DID          string
+	Handle       string
+	LinkUsername string
+}
+
+// FinishAuthorization exchanges the authorization code from the callback
+// and returns the verified account DID.
+func (c *BskyOAuthClient) FinishAuthorization(ctx context.Context, query url.Values) (*BskyOAuthResult, error) {
+	state := query.Get("state")
+	if state == "" {
+		return nil, errors.New("missing state")
+	}
+
+	var linkUsername, did sql.NullString
+	var issuer, tokenEndpoint, verifier, dpopKeyStr, nonce string
+	if err := db.QueryRowContext(ctx, `
+		DELETE FROM bsky_oauth_requests
+		WHERE state = ?
+		AND created_at >= ?
+		RETURNING link_username, did, issuer, token_endpoint, pkce_verifier, dpop_key, dpop_nonce
+	`, state, time.Now().UTC().Add(-10*time.Minute).Format(time.DateTime)).Scan(&linkUsername, &did, &issuer, &tokenEndpoint, &verifier, &dpopKeyStr, &nonce); err != nil {
+		return nil, fmt.Errorf("unknown oauth state: %w", err)
+	}
+
+	if errMsg := query.Get("error"); errMsg != "" {
+		return nil, fmt.Errorf("authorization failed: %s %s", errMsg, query.Get("error_description"))
+	}
+	if query.Get("iss") != issuer {
+		return nil, fmt.Errorf("issuer mismatch: %q != %q", query.Get("iss"), issuer)
+	}
+
+	dpopKeyDER, err := base64.StdEncoding.DecodeString(dpopKeyStr)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(dpopKeyDER)
+	if err != nil {
+		return nil, err
+	}
+	dpopKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("dpop key is not ecdsa")
+	}
+
+	var token BskyTokenResponse
+	if _, err := c.postDPoP(ctx, tokenEndpoint, url.Values{
+		"client_id":     {c.ClientID},
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {c.RedirectURI},
+		"code_verifier": {verifier},
+	}, dpopKey, nonce, &token); err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(strings.Fields(token.Scope), "atproto") {
+		return nil, fmt.Errorf("unexpected token scope: %q", token.Scope)
+	}
+
+	sub, err := syntax.ParseDID(token.Sub)
+	if err != nil {
+		return nil, err
+	}
+	if did.Valid && did.String != sub.String() {
+		return nil, fmt.Errorf("token sub %s does not match %s", sub, did.String)
+	}
+
+	// The authorization server must be authoritative for the account,
+	// otherwise any server could claim any DID.
+	ident, err := c.Directory.LookupDID(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := c.resolveAuthServer(ctx, ident.PDSEndpoint())
+	if err != nil {
+		return nil, err
+	}
+	if meta.Issuer != issuer {
+		return nil, fmt.Errorf("issuer %s is not authoritative for %s", issuer, sub)
+	}
+
+	return &BskyOAuthResult{
+		DID:          sub.String(),
+		Handle:       ident.Handle.String(),
+		LinkUsername: linkUsername.String,
+	}, nil
+}
+
+func (c *BskyOAuthClient) resolveAuthServer(ctx context.Context, serverURL string) (*BskyAuthServerMetadata, error) {
+	if serverURL == "" {
+		return nil, errBskyAccountNotFound
+	}
+
+	issuer := serverURL
+	var resource struct {
+		AuthorizationServers []string `json:"authorization_servers"`
+	}
+	if err := c.getJSON(ctx, serverURL+"/.well-known/oauth-protected-resource", &resource); err == nil && len(resource.AuthorizationServers) > 0 {
+		issuer = strings.TrimSuffix(resource.AuthorizationServers[0], "/")
+	}
+
+	meta := BskyAuthServerMetadata{}
+	if err := c.getJSON(ctx, issuer+"/.well-known/oauth-authorization-server", &meta); err != nil {
+		slog.WarnContext(ctx, "get bsky authorization server metadata failed", "issuer", issuer, "err", err)
+		return nil, errBskyAccountNotFound
+	}
+	if meta.Issuer != issuer {
+		return nil, fmt.Errorf("authorization server issuer mismatch: %q != %q", meta.Issuer, issuer)
+	}
+	if meta.PushedAuthorizationRequestEndpoint == "" || meta.TokenEndpoint == "" || meta.AuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("incomplete authorization server metadata from %s", issuer)
+	}
+	if len(meta.DPoPSigningAlgValuesSupported) > 0 && !slices.Contains(meta.DPoPSigningAlgValuesSupported, "ES256") {
+		return nil, fmt.Errorf("authorization server %s does not support ES256 DPoP", issuer)
+	}
+
+	return &meta, nil
+}
+
+func (c *BskyOAuthClient) getJSON(ctx context.Context, u string, v any) error {
+	if err := c.checkServerURL(u); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// postDPoP posts form with a DPoP proof, retrying once when the server
+// asks for a fresh nonce. It returns the last nonce the server handed out.
+func (c *BskyOAuthClient) postDPoP(ctx context.Context, endpoint string, form url.Values, key *ecdsa.PrivateKey, nonce string, v any) (string, error) {
+	if err := c.checkServerURL(endpoint); err != nil {
+		return nonce, err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		proof, err := dpopProof(key, http.MethodPost, endpoint, nonce)
+		if err != nil {
+			return nonce, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nonce, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("DPoP", proof)
+
+		res, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nonce, err
+		}
+		body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		res.Body.Close()
+		if err != nil {
+			return nonce, err
+		}
+
+		if n := res.Header.Get("DPoP-Nonce"); n != "" {
+			nonce = n
+		}
+
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return nonce, json.Unmarshal(body, v)
+		}
+
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &oauthErr)
+		if oauthErr.Error == "use_dpop_nonce" && attempt == 0 {
+			continue
+		}
+
+		return nonce, fmt.Errorf("POST %s: %s %s", endpoint, res.Status, body)
+	}
+
+	return nonce, fmt.Errorf("POST %s: dpop nonce retry failed", endpoint)
+}
+
+// dpopProof builds an ES256 DPoP proof JWT as described in RFC 9449.
+func dpopProof(key *ecdsa.PrivateKey, method string, u string, nonce string) (string, error) {
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	// Uncompressed point: 0x04 || X || Y
+	point := pub.Bytes()
+
+	header, err := json.Marshal(map[string]any{
+		"typ": "dpop+jwt",
+		"alg": "ES256",
+		"jwk": map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(point[1:33]),
+			"y":   base64.RawURLEncoding.EncodeToString(point[33:]),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims := map[string]any{
+		"jti": randomToken(16),
+		"htm": method,
+		"htu": u,
+		"iat": time.Now().Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(crand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// bskyUsername derives a username candidate from a handle, e.g.
+// "alice.bsky.social" becomes "alice".
+func bskyUsername(handle string) string {
+	if handle == "" || handle == syntax.HandleInvalid.String() {
+		return "bsky"
+	}
+
+	base := handle
+	if h, _, ok := strings.Cut(handle, "."); ok && len(h) >= 3 {
+		base = h
+	}
+	return base
+}
+
+// uniqueUsername turns base into a username that passes the same checks as
+// sign-up and isn't taken yet, appending a number when base is taken or
+// rejected, such as a reserved name.
+func uniqueUsername(ctx context.Context, base string) (string, error) {
+	base = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_' {
+			return r
+		}
+		return -1
+	}, base)
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	for i := 0; i < 100; i++ {
+		candidate := base
+		if i > 0 {
+			n, err := crand.Int(crand.Reader, big.NewInt(100000))
+			if err != nil {
+				return "", err
+			}
+			candidate = fmt.Sprintf("%s%d", base, n.Int64())
+		}
+		if validateUsername(candidate) != "" {
+			continue
+		}
+
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE username = ? COLLATE NOCASE)", candidate).Scan(&exists); err != nil {
+			return "", err
+		} else if !exists {
+			return candidate, nil
+		}
+	}
+
+	return "", errors.New("no free username")
+}
+
+// setBskyStateCookie binds the OAuth state to the browser that started the
+// flow, so a callback URL from someone else's flow can't log it in. An
+// empty state clears the cookie.
+func setBskyStateCookie(w http.ResponseWriter, state string) {
+	cookie := http.Cookie{
+		Name:     "bsky_state",
+		Value:    state,
+		Path:     "/bsky-oauth-callback/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, &cookie)
+}
+
+func randomToken(n int) string {
+	bs := make([]byte, n)
+	crand.Read(bs)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
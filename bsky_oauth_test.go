@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// decodeDPoPProof splits proof into its header and claims, checking its
+// signature against key.
+func decodeDPoPProof(t *testing.T, proof string, key *ecdsa.PrivateKey) (map[string]any, map[string]any) {
+	t.Helper()
+
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		t.Fatalf("proof has %d parts, want 3", len(parts))
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("signature %q isn't 64 bytes of base64url: %v", parts[2], err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Fatal("signature doesn't verify")
+	}
+
+	var header, claims map[string]any
+	for i, v := range []*map[string]any{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return header, claims
+}
+
+func TestDPoPProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		nonce string
+	}{
+		{"without nonce", ""},
+		{"with nonce", "server-nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof, err := dpopProof(key, http.MethodPost, "https://pds.example/oauth/token", tt.nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, claims := decodeDPoPProof(t, proof, key)
+
+			if header["typ"] != "dpop+jwt" || header["alg"] != "ES256" {
+				t.Errorf("header = %v, want typ dpop+jwt and alg ES256", header)
+			}
+			jwk, _ := header["jwk"].(map[string]any)
+			pub, err := key.PublicKey.ECDH()
+			if err != nil {
+				t.Fatal(err)
+			}
+			point := pub.Bytes()
+			x := base64.RawURLEncoding.EncodeToString(point[1:33])
+			y := base64.RawURLEncoding.EncodeToString(point[33:])
+			if jwk["kty"] != "EC" || jwk["crv"] != "P-256" || jwk["x"] != x || jwk["y"] != y {
+				t.Errorf("jwk = %v, want the public key", jwk)
+			}
+
+			if claims["htm"] != http.MethodPost || claims["htu"] != "https://pds.example/oauth/token" {
+				t.Errorf("htm, htu = %v, %v", claims["htm"], claims["htu"])
+			}
+			if jti, _ := claims["jti"].(string); jti == "" {
+				t.Error("jti is empty")
+			}
+			if _, ok := claims["iat"].(float64); !ok {
+				t.Errorf("iat = %v, want a number", claims["iat"])
+			}
+			if nonce, ok := claims["nonce"]; tt.nonce == "" && ok || tt.nonce != "" && nonce != tt.nonce {
+				t.Errorf("nonce = %v, want %q", nonce, tt.nonce)
+			}
+		})
+	}
+}
+
+func TestPostDPoP(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each response is a status, the DPoP-Nonce header and the body.
+	type response struct {
+		status int
+		nonce  string
+		body   string
+	}
+	tests := []struct {
+		name      string
+		responses []response
+		// wantNonces are the nonces the proofs of each request carry.
+		wantNonces []string
+		wantNonce  string
+		wantErr    bool
+	}{
+		{
+			name:       "accepted",
+			responses:  []response{{200, "n1", `{"value":"ok"}`}},
+			wantNonces: []string{"n0"},
+			wantNonce:  "n1",
+		},
+		{
+			name: "retried with the new nonce",
+			responses: []response{
+				{400, "n1", `{"error":"use_dpop_nonce"}`},
+				{200, "n2", `{"value":"ok"}`},
+			},
+			wantNonces: []string{"n0", "n1"},
+			wantNonce:  "n2",
+		},
+		{
+			name: "retried only once",
+			responses: []response{
+				{400, "n1", `{"error":"use_dpop_nonce"}`},
+				{400, "n2", `{"error":"use_dpop_nonce"}`},
+			},
+			wantNonces: []string{"n0", "n1"},
+			wantNonce:  "n2",
+			wantErr:    true,
+		},
+		{
+			name:       "other errors aren't retried",
+			responses:  []response{{400, "", `{"error":"invalid_grant"}`}},
+			wantNonces: []string{"n0"},
+			wantNonce:  "n0",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nonces []string
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, claims := decodeDPoPProof(t, r.Header.Get("DPoP"), key)
+				if claims["htu"] != "https://"+r.Host+r.URL.Path {
+					t.Errorf("htu = %v, want the endpoint", claims["htu"])
+				}
+				if r.FormValue("code") != "abc" {
+					t.Errorf("code = %q, want the form", r.FormValue("code"))
+				}
+				nonce, _ := claims["nonce"].(string)
+				nonces = append(nonces, nonce)
+
+				res := tt.responses[len(nonces)-1]
+				if res.nonce != "" {
+					w.Header().Set("DPoP-Nonce", res.nonce)
+				}
+				w.WriteHeader(res.status)
+				w.Write([]byte(res.body))
+			}))
+			defer srv.Close()
+
+			c := &BskyOAuthClient{HTTPClient: srv.Client()}
+			var v struct {
+				Value string `json:"value"`
+			}
+			nonce, err := c.postDPoP(t.Context(), srv.URL+"/oauth/token", url.Values{"code": {"abc"}}, key, "n0", &v)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && v.Value != "ok" {
+				t.Errorf("decoded %+v, want the body", v)
+			}
+			if nonce != tt.wantNonce {
+				t.Errorf("nonce = %q, want %q", nonce, tt.wantNonce)
+			}
+			if strings.Join(nonces, ",") != strings.Join(tt.wantNonces, ",") {
+				t.Errorf("proof nonces = %v, want %v", nonces, tt.wantNonces)
+			}
+		})
+	}
+}
+
+func TestCheckServerURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		wantErr      bool
+	}{
+		{"https://pds.example", false, false},
+		{"http://pds.example", false, true},
+		{"http://localhost:2583", true, false},
+		{"ftp://pds.example", true, true},
+	}
+	for _, tt := range tests {
+		c := &BskyOAuthClient{AllowPrivate: tt.allowPrivate}
+		if err := c.checkServerURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("checkServerURL(%q) with AllowPrivate %v = %v, want error %v", tt.url, tt.allowPrivate, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.215.14", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
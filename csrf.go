@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// csrfKey derives per-session CSRF tokens, see csrfToken.
+var csrfKey []byte
+
+// csrfExemptPrefixes are non-GET routes called by other servers rather than
+// by our pages.
+var csrfExemptPrefixes = []string{"/ses-notifications/"}
+
+func initCSRFKey(encodedKey string) error {
+	if encodedKey == "" {
+		slog.Warn("CSRF_KEY is not set, open pages will need a reload after a restart")
+		csrfKey = make([]byte, 32)
+		_, err := crand.Read(csrfKey)
+		return err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return err
+	}
+	if len(key) < 32 {
+		return errors.New("CSRF_KEY must be at least 32 bytes")
+	}
+
+	csrfKey = key
+	return nil
+}
+
+// csrfToken returns the CSRF token for the browser making r. Logged in
+// browsers get a token bound to their session cookie; anonymous ones get a
+// csrf cookie to bind to, which is set on w when missing.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie("session"); err == nil {
+		return signCSRF("session:" + cookie.Value)
+	}
+
+	if cookie, err := r.Cookie("csrf"); err == nil {
+		return signCSRF("anonymous:" + cookie.Value)
+	}
+
+	value := randomToken(32)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "csrf",
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionMaxTTL),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return signCSRF("anonymous:" + value)
+}
+
+func signCSRF(binding string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validCSRFToken(r *http.Request, token string) bool {
+	var binding string
+	if cookie, err := r.Cookie("session"); err == nil {
+		binding = "session:" + cookie.Value
+	} else if cookie, err := r.Cookie("csrf"); err == nil {
+		binding = "anonymous:" + cookie.Value
+	} else {
+		return false
+	}
+
+	return hmac.Equal([]byte(token), []byte(signCSRF(binding)))
+}
+
+// sameOrigin rejects requests that browsers label as cross-site, and those
+// whose Origin is neither this host nor PUBLIC_URL.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if public, err := url.Parse(publicURL); err == nil && u.Host == public.Host {
+		return true
+	}
+
+	return u.Host == r.Host
+}
+
+// csrfProtect requires a valid CSRF token, sent by htmx in the X-CSRF-Token
+// header or by plain forms as csrf_token, on every non-GET request.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, prefix := range csrfExemptPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" {
+			token = r.PostFormValue("csrf_token")
+		}
+
+		if !sameOrigin(r) || !validCSRFToken(r, token) {
+			writeError(w, r, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
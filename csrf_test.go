@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	openTestDB(t)
+	loadTestTemplates(t)
+	csrfKey = make([]byte, 32)
+
+	handler := withUser(csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	anonymous := &http.Cookie{Name: "csrf", Value: "browser"}
+	session := &http.Cookie{Name: "session", Value: "session"}
+	anonymousToken := signCSRF("anonymous:browser")
+	sessionToken := signCSRF("session:session")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		cookie *http.Cookie
+		header map[string]string
+		form   url.Values
+		want   int
+	}{
+		{name: "GET needs no token", method: http.MethodGet, want: http.StatusNoContent},
+		{name: "HEAD needs no token", method: http.MethodHead, want: http.StatusNoContent},
+		{name: "no token", method: http.MethodPost, cookie: anonymous, want: http.StatusForbidden},
+		{name: "no cookie", method: http.MethodPost, header: map[string]string{"X-CSRF-Token": anonymousToken}, want: http.StatusForbidden},
+		{name: "header token", method: http.MethodPost, cookie: anonymous, header: map[string]string{"X-CSRF-Token": anonymousToken}, want: http.StatusNoContent},
+		{name: "form token", method: http.MethodPost, cookie: anonymous, form: url.Values{"csrf_token": {anonymousToken}}, want: http.StatusNoContent},
+		{name: "session token", method: http.MethodDelete, cookie: session, header: map[string]string{"X-CSRF-Token": sessionToken}, want: http.StatusNoContent},
+		{name: "token for another browser", method: http.MethodPost, cookie: anonymous, header: map[string]string{"X-CSRF-Token": signCSRF("anonymous:other")}, want: http.StatusForbidden},
+		{name: "anonymous token with a session", method: http.MethodPost, cookie: session, header: map[string]string{"X-CSRF-Token": anonymousToken}, want: http.StatusForbidden},
+		{name: "same origin", method: http.MethodPost, cookie: anonymous, header: map[string]string{"X-CSRF-Token": anonymousToken, "Origin": "http://example.com", "Sec-Fetch-Site": "same-origin"}, want: http.StatusNoContent},
+		{name: "public URL origin", method: http.MethodPost, cookie: anonymous, header: map[string]string{"X-CSRF-Token": anonymousToken, "Origin": publicURL}, want: http.StatusNoContent},
+		{name: "cross-site", method: http.MethodPost, cookie: anonymous, header: map[string]string{"X-CSRF-Token": anonymousToken, "Sec-Fetch-Site": "cross-site"}, want: http.StatusForbidden},
+		{name: "other origin", method: http.MethodPost, cookie: anonymous, header: map[string]string{"X-CSRF-Token": anonymousToken, "Origin": "https://evil.example"}, want: http.StatusForbidden},
+		{name: "exempt route", method: http.MethodPost, path: "/ses-notifications/", want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = "/log-out/"
+			}
+			r := httptest.NewRequest(tt.method, path, strings.NewReader(tt.form.Encode()))
+			if tt.form != nil {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			// Errors render as a fragment, which needs no vendored files.
+			r.Header.Set("HX-Request", "true")
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
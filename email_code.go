@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emailCodeTTL         = 10 * time.Minute
+	emailCodeMaxAttempts = 5
+	emailCodeLockout     = 15 * time.Minute
+)
+
+var (
+	errEmailCodeInvalid = errors.New("email code invalid")
+	errEmailCodeExpired = errors.New("email code expired")
+	errEmailCodeLocked  = errors.New("too many wrong email codes")
+)
+
+// emailCodeKey keys the HMAC used to store codes, so a leaked database
+// doesn't hand out codes that can be brute forced offline.
+var emailCodeKey []byte
+
+func initEmailCodeKey(encodedKey string) error {
+	if encodedKey == "" {
+		slog.Warn("EMAIL_CODE_KEY is not set, pending email codes won't survive a restart")
+		emailCodeKey = make([]byte, 32)
+		_, err := crand.Read(emailCodeKey)
+		return err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return err
+	}
+	if len(key) < 32 {
+		return errors.New("EMAIL_CODE_KEY must be at least 32 bytes")
+	}
+
+	emailCodeKey = key
+	return nil
+}
+
+func newEmailCode() (string, error) {
+	n, err := crand.Int(crand.Reader, big.NewInt(900000))
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(n.Int64()+100000, 10), nil
+}
+
+func hashEmailCode(email string, code string) string {
+	mac := hmac.New(sha256.New, emailCodeKey)
+	mac.Write([]byte(strings.ToLower(email)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func emailCodeExpiry() string {
+	return time.Now().UTC().Add(emailCodeTTL).Format(time.DateTime)
+}
+
+// checkEmailLockout returns errEmailCodeLocked while email is locked out
+// after too many wrong codes.
+func checkEmailLockout(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}, email string) error {
+	var locked bool
+	if err := q.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM email_code_lockouts
+			WHERE email = ? AND locked_until > ?
+		)
+	`, email, time.Now().UTC().Format(time.DateTime)).Scan(&locked); err != nil {
+		return err
+	}
+
+	if locked {
+		return errEmailCodeLocked
+	}
+	return nil
+}
+
+// consumeEmailCode checks code against the pending code for email in table,
+// which is user_sign_up_email_tokens, user_log_in_email_tokens or
+// user_email_change_tokens. A correct code is deleted so it can't be used
+// twice; a wrong one counts towards the lockout. The caller must commit tx
+// even when an error is returned, so attempt counters are kept.
+func consumeEmailCode(tx *sql.Tx, table string, email string, code string) error {
+	if table != "user_sign_up_email_tokens" && table != "user_log_in_email_tokens" && table != "user_email_change_tokens" {
+		panic("consumeEmailCode: unknown table " + table)
+	}
+
+	if err := checkEmailLockout(tx, email); err != nil {
+		return err
+	}
+
+	var tokenHash, expiresAt string
+	var attempts int
+	if err := tx.QueryRow(`
+		SELECT token_hash, attempts, expires_at FROM `+table+`
+		WHERE email = ?
+	`, email).Scan(&tokenHash, &attempts, &expiresAt); errors.Is(err, sql.ErrNoRows) {
+		return errEmailCodeInvalid
+	} else if err != nil {
+		return err
+	}
+
+	if expiresAt <= time.Now().UTC().Format(time.DateTime) {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE email = ?", email); err != nil {
+			return err
+		}
+		return errEmailCodeExpired
+	}
+
+	if !hmac.Equal([]byte(tokenHash), []byte(hashEmailCode(email, code))) {
+		if attempts+1 < emailCodeMaxAttempts {
+			if _, err := tx.Exec("UPDATE "+table+" SET attempts = attempts + 1 WHERE email = ?", email); err != nil {
+				return err
+			}
+			return errEmailCodeInvalid
+		}
+
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE email = ?", email); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO email_code_lockouts (email, locked_until)
+			VALUES (?, ?)
+			ON CONFLICT DO UPDATE SET locked_until = excluded.locked_until
+		`, email, time.Now().UTC().Add(emailCodeLockout).Format(time.DateTime)); err != nil {
+			return err
+		}
+		return errEmailCodeLocked
+	}
+
+	if _, err := tx.Exec("DELETE FROM "+table+" WHERE email = ?", email); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeEmailCodeError maps consumeEmailCode errors to statuses and the
+// messages of the verify page for purpose: "sign-up", "log-in" or
+// "email-change".
+func writeEmailCodeError(w http.ResponseWriter, r *http.Request, purpose string, err error) {
+	switch {
+	case errors.Is(err, errEmailCodeInvalid):
+		writeErrorMessage(w, r, http.StatusNotFound, "common.code-wrong")
+	case errors.Is(err, errEmailCodeExpired):
+		writeErrorMessage(w, r, http.StatusGone, "verify-"+purpose+".expired")
+	case errors.Is(err, errEmailCodeLocked):
+		writeErrorMessage(w, r, http.StatusTooManyRequests, "common.code-locked")
+	default:
+		slog.ErrorContext(r.Context(), "request failed", "err", err)
+		writeError(w, r, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConsumeEmailCode(t *testing.T) {
+	emailCodeKey = make([]byte, 32)
+
+	const email = "alice@example.com"
+	now := time.Now().UTC()
+	future := now.Add(emailCodeTTL).Format(time.DateTime)
+	past := now.Add(-time.Minute).Format(time.DateTime)
+
+	tests := []struct {
+		name string
+		// pending is whether a code 123456 is pending, with attempts
+		// wrong tries so far and expiring at expiresAt.
+		pending     bool
+		attempts    int
+		expiresAt   string
+		lockedUntil string
+		code        string
+
+		wantErr error
+		// wantAttempts is the attempts left on the pending code, or -1
+		// if it should be gone.
+		wantAttempts int
+		wantLocked   bool
+	}{
+		{
+			name:         "correct code",
+			pending:      true,
+			expiresAt:    future,
+			code:         "123456",
+			wantAttempts: -1,
+		},
+		{
+			name:         "wrong code",
+			pending:      true,
+			attempts:     1,
+			expiresAt:    future,
+			code:         "654321",
+			wantErr:      errEmailCodeInvalid,
+			wantAttempts: 2,
+		},
+		{
+			name:         "last wrong attempt locks out",
+			pending:      true,
+			attempts:     emailCodeMaxAttempts - 1,
+			expiresAt:    future,
+			code:         "654321",
+			wantErr:      errEmailCodeLocked,
+			wantAttempts: -1,
+			wantLocked:   true,
+		},
+		{
+			name:         "expired code",
+			pending:      true,
+			expiresAt:    past,
+			code:         "123456",
+			wantErr:      errEmailCodeExpired,
+			wantAttempts: -1,
+		},
+		{
+			name:         "no pending code",
+			code:         "123456",
+			wantErr:      errEmailCodeInvalid,
+			wantAttempts: -1,
+		},
+		{
+			name:         "locked out email",
+			pending:      true,
+			expiresAt:    future,
+			lockedUntil:  now.Add(emailCodeLockout).Format(time.DateTime),
+			code:         "123456",
+			wantErr:      errEmailCodeLocked,
+			wantAttempts: 0,
+			wantLocked:   true,
+		},
+		{
+			name:         "lockout over",
+			pending:      true,
+			expiresAt:    future,
+			lockedUntil:  past,
+			code:         "123456",
+			wantAttempts: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+
+			if tt.pending {
+				if _, err := db.Exec(`
+					INSERT INTO user_log_in_email_tokens (email, token_hash, attempts, expires_at)
+					VALUES (?, ?, ?, ?)
+				`, email, hashEmailCode(email, "123456"), tt.attempts, tt.expiresAt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.lockedUntil != "" {
+				if _, err := db.Exec("INSERT INTO email_code_lockouts (email, locked_until) VALUES (?, ?)", email, tt.lockedUntil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = consumeEmailCode(tx, "user_log_in_email_tokens", email, tt.code)
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			attempts := -1
+			if err := db.QueryRow("SELECT attempts FROM user_log_in_email_tokens WHERE email = ?", email).Scan(&attempts); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				t.Fatal(err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+
+			locked := errors.Is(checkEmailLockout(db, email), errEmailCodeLocked)
+			if locked != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", locked, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestHashEmailCode(t *testing.T) {
+	emailCodeKey = make([]byte, 32)
+
+	if hashEmailCode("Alice@Example.com", "123456") != hashEmailCode("alice@example.com", "123456") {
+		t.Error("hash depends on the case of the email")
+	}
+	if hashEmailCode("alice@example.com", "123456") == hashEmailCode("bob@example.com", "123456") {
+		t.Error("hash doesn't depend on the email")
+	}
+	if hashEmailCode("alice@example.com", "123456") == hashEmailCode("alice@example.com", "123457") {
+		t.Error("hash doesn't depend on the code")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type requestIDContextKey struct{}
+
+// withRequestID gives every request an ID, sent back in X-Request-ID and
+// shown on error responses, so a user reporting an error can point us to
+// its log lines.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, r.WithContext(contextWithRequestID(r.Context(), id)))
+	})
+}
+
+// newRequestID returns a random ID short enough for users to quote.
+func newRequestID() string {
+	return rand.Text()[:12]
+}
+
+// contextWithRequestID returns ctx carrying id, which is added to every log
+// line written with it. Background work gets its own.
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// requestID returns the ID withRequestID gave r.
+func requestID(r *http.Request) string {
+	return requestIDFromContext(r.Context())
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// withErrorPages serves mux, answering requests it has no route for through
+// writeError instead of with its plain text 404 and 405.
+func withErrorPages(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern == "" {
+			// mux only says which of the two it is by answering.
+			probe := &routeProbe{header: http.Header{}}
+			h.ServeHTTP(probe, r)
+			if probe.status == http.StatusNotFound || probe.status == http.StatusMethodNotAllowed {
+				if allow := probe.header.Get("Allow"); allow != "" {
+					w.Header().Set("Allow", allow)
+				}
+				writeError(w, r, probe.status)
+				return
+			}
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// routeProbe is a ResponseWriter that keeps the header and status and drops
+// the body.
+type routeProbe struct {
+	header http.Header
+	status int
+}
+
+func (p *routeProbe) Header() http.Header { return p.header }
+
+func (p *routeProbe) WriteHeader(status int) {
+	if p.status == 0 {
+		p.status = status
+	}
+}
+
+func (p *routeProbe) Write(b []byte) (int, error) {
+	p.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// ErrorData is what the error page and fragment are rendered with.
+type ErrorData struct {
+	Status int
+	// Message is the catalog key of the message, see errorMessage.
+	Message   string
+	RequestID string
+}
+
+// errorMessage returns the catalog key describing status to users.
+func errorMessage(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusConflict, http.StatusGone, http.StatusTooManyRequests:
+		return "error." + strconv.Itoa(status)
+	}
+	if status >= 500 {
+		return "error.500"
+	}
+	return "error.400"
+}
+
+// writeError responds to r with status in the shape its client expects:
+// problem details for /xrpc/ routes, a fragment for htmx and the error page
+// for everything else.
+func writeError(w http.ResponseWriter, r *http.Request, status int) {
+	writeErrorMessage(w, r, status, errorMessage(status))
+}
+
+// writeErrorMessage is writeError showing the catalog key message instead
+// of the one for status, for errors the page can explain better.
+func writeErrorMessage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	data := ErrorData{
+		Status:    status,
+		Message:   message,
+		RequestID: requestID(r),
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/xrpc/"):
+		writeProblem(w, r, status)
+	case r.Header.Get("HX-Request") == "true":
+		executeTemplatesStatus(w, r, status, data, "", "error-message")
+	default:
+		executeErrorPage(w, r, data)
+	}
+}
+
+// executeErrorPage renders the error page for data.
+func executeErrorPage(w http.ResponseWriter, r *http.Request, data ErrorData) {
+	if err := renderPage(w, r, data.Status, "error.tmpl", data); err != nil {
+		slog.ErrorContext(r.Context(), "render error page failed", "err", err)
+		http.Error(w, http.StatusText(data.Status), data.Status)
+	}
+}
+
+// Problem is an RFC 9457 problem details object. Error carries the XRPC
+// error name, which is what atproto clients read.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Instance  string `json:"instance"`
+	RequestID string `json:"requestId"`
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+}
+
+// xrpcErrors names statuses the way atproto services do.
+var xrpcErrors = map[int]string{
+	http.StatusBadRequest:          "InvalidRequest",
+	http.StatusUnauthorized:        "AuthenticationRequired",
+	http.StatusForbidden:           "Forbidden",
+	http.StatusNotFound:            "NotFound",
+	http.StatusTooManyRequests:     "RateLimitExceeded",
+	http.StatusInternalServerError: "InternalServerError",
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int) {
+	name, ok := xrpcErrors[status]
+	if !ok {
+		name = strings.ReplaceAll(http.StatusText(status), " ", "")
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		RequestID: requestID(r),
+		Error:     name,
+		Message:   http.StatusText(status),
+	})
+}
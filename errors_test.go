@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithErrorPages(t *testing.T) {
+	openTestDB(t)
+	loadTestTemplates(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /xrpc/app.bsky.feed.getFeedSkeleton", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /log-out/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /page/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := withRequestID(withUser(withErrorPages(mux)))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		htmx   bool
+		want   int
+		// wantType is the start of the Content-Type.
+		wantType  string
+		wantAllow string
+		// wantLocation is where a redirect goes, whichever 3xx it is.
+		wantLocation string
+	}{
+		{name: "route", method: http.MethodPost, path: "/log-out/", want: http.StatusNoContent},
+		{name: "redirect to the slash", method: http.MethodGet, path: "/page", wantLocation: "/page/"},
+		{name: "XRPC unknown path", method: http.MethodGet, path: "/xrpc/app.bsky.feed.nope", want: http.StatusNotFound, wantType: "application/problem+json"},
+		{name: "XRPC wrong method", method: http.MethodPost, path: "/xrpc/app.bsky.feed.getFeedSkeleton", want: http.StatusMethodNotAllowed, wantType: "application/problem+json", wantAllow: "GET, HEAD"},
+		{name: "htmx unknown path", method: http.MethodPost, path: "/nope/", htmx: true, want: http.StatusNotFound, wantType: "text/html"},
+		{name: "htmx wrong method", method: http.MethodGet, path: "/log-out/", htmx: true, want: http.StatusMethodNotAllowed, wantType: "text/html", wantAllow: "POST"},
+		{name: "page unknown path", method: http.MethodGet, path: "/nope/", want: http.StatusNotFound, wantType: "text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.htmx {
+				r.Header.Set("HX-Request", "true")
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if tt.wantLocation != "" {
+				if w.Code/100 != 3 || w.Header().Get("Location") != tt.wantLocation {
+					t.Errorf("status = %d to %q, want a redirect to %s", w.Code, w.Header().Get("Location"), tt.wantLocation)
+				}
+				return
+			}
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if tt.wantType == "" {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.wantType)
+			}
+
+			// Every error carries the request ID to quote.
+			id := w.Header().Get("X-Request-ID")
+			if tt.wantType == "application/problem+json" {
+				var problem Problem
+				if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+					t.Fatal(err)
+				}
+				if problem.Status != tt.want || problem.RequestID != id {
+					t.Errorf("problem = %+v, want status %d and request ID %s", problem, tt.want, id)
+				}
+			} else if !strings.Contains(w.Body.String(), id) {
+				t.Errorf("body doesn't show request ID %s", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// Each file in locale/ is the message catalog of one locale, a flat JSON
+// object of keys to messages. Messages may hold fmt verbs for the arguments
+// of the "t" template func. The first locale is the default, and the one
+// every other catalog falls back to.
+var (
+	siteLocales       = []string{"zh-TW", "nan-TW", "en"}
+	siteLocaleMatcher = language.NewMatcher([]language.Tag{
+		language.MustParse("zh-TW"),
+		language.MustParse("nan-TW"),
+		language.MustParse("en"),
+	})
+	catalogs = map[string]map[string]string{}
+)
+
+// localeCookieMaxAge is how long a locale picked without logging in is
+// remembered.
+const localeCookieMaxAge = 365 * 24 * time.Hour
+
+func parseCatalogs(fsys fs.FS) (map[string]map[string]string, error) {
+	parsed := map[string]map[string]string{}
+	for _, locale := range siteLocales {
+		data, err := fs.ReadFile(fsys, "locale/"+locale+".json")
+		if err != nil {
+			return nil, err
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, fmt.Errorf("locale/%s.json: %w", locale, err)
+		}
+		parsed[locale] = catalog
+	}
+
+	for _, locale := range siteLocales[1:] {
+		for key := range parsed[siteLocales[0]] {
+			if _, ok := parsed[locale][key]; !ok {
+				slog.Warn("missing message", "locale", locale, "key", key)
+			}
+		}
+	}
+
+	return parsed, nil
+}
+
+// translator returns the "t" template func for locale, which looks key up
+// in cats and formats it with args.
+func translator(cats map[string]map[string]string, locale string) func(key string, args ...any) string {
+	return func(key string, args ...any) string {
+		msg, ok := cats[locale][key]
+		if !ok {
+			if msg, ok = cats[siteLocales[0]][key]; !ok {
+				slog.Warn("unknown message", "key", key)
+				msg = key
+			}
+		}
+		if len(args) > 0 {
+			return fmt.Sprintf(msg, args...)
+		}
+		return msg
+	}
+}
+
+// translate looks key up for messages written from Go rather than a
+// template.
+func translate(locale string, key string, args ...any) string {
+	templatesMu.RLock()
+	cats := catalogs
+	templatesMu.RUnlock()
+
+	return translator(cats, locale)(key, args...)
+}
+
+// siteLocale picks the locale r's page is shown in: the logged in user's
+// setting, then the "locale" cookie, then the browser's languages.
+func siteLocale(r *http.Request) string {
+	if u, err := currentUser(r); err == nil && u != nil && slices.Contains(siteLocales, u.Locale) {
+		return u.Locale
+	}
+
+	if cookie, err := r.Cookie("locale"); err == nil && slices.Contains(siteLocales, cookie.Value) {
+		return cookie.Value
+	}
+
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, i, _ := siteLocaleMatcher.Match(tags...)
+	return siteLocales[i]
+}
+
+// setLocaleCookie remembers locale on the browser making the request, or
+// forgets it if locale is empty.
+func setLocaleCookie(w http.ResponseWriter, locale string) {
+	cookie := &http.Cookie{
+		Name:     "locale",
+		Value:    locale,
+		Path:     "/",
+		MaxAge:   int(localeCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if locale == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setupLogging makes slog write JSON lines to w at level and above, each
+// with the request ID of its context. Lines still written through the log
+// package are errors.
+func setupLogging(w io.Writer, level slog.Level) {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     level,
+	})
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	slog.SetLogLoggerLevel(slog.LevelError)
+}
+
+// requestIDHandler adds the request ID of the context to every record.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// backgroundContext returns a context for one run of a background job,
+// with a request ID of its own.
+func backgroundContext() context.Context {
+	return contextWithRequestID(context.Background(), newRequestID())
+}
+
+// accessLog logs every request once it's served. Static files are only
+// logged at debug level.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if strings.HasPrefix(r.URL.Path, "/static/") {
+			level = slog.LevelDebug
+		}
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("ip", clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// RotatingFile is a log file that is renamed to Path.<time> and started
+// afresh when it grows past MaxSize or a new period of Every begins. Only
+// the newest MaxBackups old files are kept.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	Every      time.Duration
+	MaxBackups int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// newRotatingFile opens path for appending, rotating it as set by
+// LOG_MAX_SIZE (bytes, 100 MiB by default), LOG_ROTATE_EVERY (24h) and
+// LOG_MAX_BACKUPS (14).
+func newRotatingFile(path string) (*RotatingFile, error) {
+	f := &RotatingFile{
+		Path:       path,
+		MaxSize:    100 << 20,
+		Every:      24 * time.Hour,
+		MaxBackups: 14,
+	}
+
+	if v, ok := os.LookupEnv("LOG_MAX_SIZE"); ok {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("LOG_MAX_SIZE: %w", err)
+		}
+		f.MaxSize = size
+	}
+	if v, ok := os.LookupEnv("LOG_ROTATE_EVERY"); ok {
+		every, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("LOG_ROTATE_EVERY: %w", err)
+		}
+		f.Every = every
+	}
+	if v, ok := os.LookupEnv("LOG_MAX_BACKUPS"); ok {
+		backups, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("LOG_MAX_BACKUPS: %w", err)
+		}
+		f.MaxBackups = backups
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// An existing file was last written when the app last ran, so a
+	// restart doesn't restart its period.
+	f.file, f.size, f.openedAt = file, info.Size(), info.ModTime()
+	if info.Size() == 0 {
+		f.openedAt = time.Now()
+	}
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.due(len(p)) {
+		if err := f.rotate(); err != nil {
+			// The line still goes to whichever file is open.
+			fmt.Fprintf(os.Stderr, "rotate %s failed: %v\n", f.Path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) due(next int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.MaxSize > 0 && f.size+int64(next) > f.MaxSize {
+		return true
+	}
+	return f.Every > 0 && !time.Now().Truncate(f.Every).Equal(f.openedAt.Truncate(f.Every))
+}
+
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	backup := f.Path + "." + time.Now().UTC().Format("20060102T150405.000")
+	renameErr := os.Rename(f.Path, backup)
+	// Without a rename this reopens the same file.
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	backups, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return err
+	}
+	// The timestamps sort oldest first.
+	slices.Sort(backups)
+	for len(backups) > f.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+type EmailMessage struct {
+	From    string
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Mailer delivers a single message. Send returns an error when the message
+// wasn't accepted, so the outbox can retry it.
+type Mailer interface {
+	Send(ctx context.Context, msg *EmailMessage) error
+}
+
+var (
+	mailer   Mailer
+	mailFrom = "台島 <no-reply@xn--kprw3s.tw>"
+)
+
+// newMailer picks the backend named by MAIL_BACKEND: "ses" (default),
+// "smtp", "file" or "console".
+func newMailer(ctx context.Context, backend string) (Mailer, error) {
+	switch backend {
+	case "", "ses":
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &SESMailer{client: ses.NewFromConfig(cfg)}, nil
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_ADDR: %w", err)
+		}
+
+		m := &SMTPMailer{Addr: addr}
+		if username, ok := os.LookupEnv("SMTP_USERNAME"); ok {
+			m.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return m, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: dir}, nil
+	case "console":
+		return &ConsoleMailer{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+}
+
+type SESMailer struct {
+	client *ses.Client
+}
+
+func (m *SESMailer) Send(ctx context.Context, msg *EmailMessage) error {
+	body := &types.Body{
+		Html: &types.Content{
+			Data: &msg.HTML,
+		},
+	}
+	if msg.Text != "" {
+		body.Text = &types.Content{
+			Data: &msg.Text,
+		}
+	}
+
+	_, err := m.client.SendEmail(ctx, &ses.SendEmailInput{
+		Destination: &types.Destination{
+			ToAddresses: []string{msg.To},
+		},
+		Message: &types.Message{
+			Subject: &types.Content{
+				Data: &msg.Subject,
+			},
+			Body: body,
+		},
+		Source: &msg.From,
+	})
+	return err
+}
+
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *EmailMessage) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+
+	data, err := buildMIME(msg)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.Addr, m.Auth, from.Address, []string{msg.To}, data)
+}
+
+// FileMailer writes each message as an .eml file, for local development.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg *EmailMessage) error {
+	data, err := buildMIME(msg)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), randomToken(6))
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0600)
+}
+
+// ConsoleMailer logs messages instead of sending them.
+type ConsoleMailer struct{}
+
+func (m *ConsoleMailer) Send(ctx context.Context, msg *EmailMessage) error {
+	body := msg.Text
+	if body == "" {
+		body = msg.HTML
+	}
+
+	slog.InfoContext(ctx, "email", "to", msg.To, "subject", msg.Subject, "body", body)
+	return nil
+}
+
+// buildMIME renders msg as an RFC 5322 message, with a multipart/alternative
+// body when there is a plain text version.
+func buildMIME(msg *EmailMessage) ([]byte, error) {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@xn--kprw3s.tw>\r\n", randomToken(16))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.Text == "" {
+		buf.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, msg.HTML); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	writer := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
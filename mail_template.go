@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	ttemplate "text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// Each file in email/ is one message type in one locale, named
+// <type>.<locale>.tmpl, and defines "subject", "text" and "html".
+// Locales without templates of their own, like nan-TW, get the first one.
+var (
+	emailLocales = []string{"zh-TW", "en"}
+	emailTmpl    = map[string]*EmailTemplate{}
+)
+
+type EmailTemplate struct {
+	Text *ttemplate.Template
+	HTML *template.Template
+}
+
+// EmailCodeData is passed to verification code templates.
+type EmailCodeData struct {
+	Username   string
+	Code       string
+	TTLMinutes int
+}
+
+// EmailChangedData is passed to the notice sent to a user's old address.
+type EmailChangedData struct {
+	Username string
+	NewEmail string
+}
+
+// emailSamples is rendered by the /dev/emails/ preview.
+var emailSamples = map[string]any{
+	"sign-up-code":      EmailCodeData{Code: "123456", TTLMinutes: int(emailCodeTTL.Minutes())},
+	"log-in-code":       EmailCodeData{Code: "123456", TTLMinutes: int(emailCodeTTL.Minutes())},
+	"email-change-code": EmailCodeData{Username: "someone", Code: "123456", TTLMinutes: int(emailCodeTTL.Minutes())},
+	"email-changed":     EmailChangedData{Username: "someone", NewEmail: maskEmail("someone.new@example.com")},
+}
+
+func parseEmailTemplates(fsys fs.FS) (map[string]*EmailTemplate, error) {
+	files, err := fs.Glob(fsys, "email/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*EmailTemplate{}
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".tmpl")
+
+		text, err := ttemplate.ParseFS(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		html, err := template.ParseFS(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = &EmailTemplate{Text: text, HTML: html}
+	}
+
+	for kind := range emailSamples {
+		if _, ok := templates[kind+"."+emailLocales[0]]; !ok {
+			return nil, fmt.Errorf("missing email template %s.%s", kind, emailLocales[0])
+		}
+	}
+
+	return templates, nil
+}
+
+// renderEmail renders the kind message in locale, falling back to the
+// default locale when there is no translation.
+func renderEmail(kind string, locale string, to string, data any) (*EmailMessage, error) {
+	templatesMu.RLock()
+	t, ok := emailTmpl[kind+"."+locale]
+	if !ok {
+		t, ok = emailTmpl[kind+"."+emailLocales[0]]
+	}
+	templatesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %s", kind)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := t.Text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.Text.ExecuteTemplate(&text, "text", data); err != nil {
+		return nil, err
+	}
+	if err := t.HTML.ExecuteTemplate(&html, "html", data); err != nil {
+		return nil, err
+	}
+
+	return &EmailMessage{
+		From:    mailFrom,
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    html.String(),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}, nil
+}
+
+// emailLocale picks the locale for mail to a user: their saved preference
+// if any, otherwise the locale r's pages are shown in.
+func emailLocale(r *http.Request, preference string) string {
+	if slices.Contains(siteLocales, preference) {
+		return preference
+	}
+	return siteLocale(r)
+}
+
+type EmailPreview struct {
+	Name    string
+	Message *EmailMessage
+}
+
+// previewEmails renders every template with its sample data.
+func previewEmails() ([]EmailPreview, error) {
+	templatesMu.RLock()
+	names := slices.Sorted(maps.Keys(emailTmpl))
+	templatesMu.RUnlock()
+
+	previews := []EmailPreview{}
+	for _, name := range names {
+		kind, locale, _ := strings.Cut(name, ".")
+		msg, err := renderEmail(kind, locale, "someone@example.com", emailSamples[kind])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		previews = append(previews, EmailPreview{Name: name, Message: msg})
+	}
+
+	return previews, nil
+}
+
+// queueEmailCode queues a verification code of kind ("sign-up-code",
+// "log-in-code" or "email-change-code") for email in the outbox within tx.
+func queueEmailCode(ctx context.Context, tx *sql.Tx, kind string, locale string, email string, data EmailCodeData) error {
+	data.TTLMinutes = int(emailCodeTTL.Minutes())
+	msg, err := renderEmail(kind, locale, email, data)
+	if err != nil {
+		return err
+	}
+
+	return enqueueEmail(ctx, tx, msg, time.Now().Add(emailCodeTTL))
+}
+
+// maskEmail hides most of the local part of email, for mail that may be
+// read by someone other than the account owner.
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+
+	first, _ := utf8.DecodeRuneInString(local)
+	return string(first) + "***@" + domain
+}
@@ -1,36 +1,33 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	crand "crypto/rand"
+	"context"
+	"crypto/subtle"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
-	mrand "math/rand"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/Masterminds/sprig/v3"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ses"
-	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
 	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/svg"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/time/rate"
-	_ "modernc.org/sqlite"
 )
 
 const (
@@ -39,11 +36,17 @@ const (
 
 var (
 	port        = "8080"
+	publicURL   = "https://xn--kprw3s.tw"
+	dbPath      = "./db"
+	dev         = false
 	db          *sql.DB
 	sessionStmt *sql.Stmt
-	tmpl        *template.Template
-	pageTmpl    map[string]*template.Template
-	minifier    *minify.M
+	// tmpl and pageTmpl are keyed by locale.
+	tmpl         map[string]*template.Template
+	pageTmpl     map[string]map[string]*template.Template
+	minifier     *minify.M
+	bskyOAuth    *BskyOAuthClient
+	threadsOAuth *ThreadsOAuthClient
 )
 
 type Event struct {
@@ -67,49 +70,163 @@ type Event struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "vendor" {
+		if err := runVendorCommand(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	logLevel := slog.LevelInfo
+	if v, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		if err := logLevel.UnmarshalText([]byte(v)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var logOutput io.Writer = os.Stdout
 	if v, ok := os.LookupEnv("LOG_FILE"); ok {
-		logFile, err := os.OpenFile(v, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		logFile, err := newRotatingFile(v)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer logFile.Close()
 
-		log.SetOutput(logFile)
+		logOutput = logFile
 	}
+	setupLogging(logOutput, logLevel)
 
 	if v, ok := os.LookupEnv("PORT"); ok {
 		port = v
 	}
+	if v, ok := os.LookupEnv("DB_PATH"); ok {
+		dbPath = v
+	}
+	// DEV reads templates and static files from the working directory
+	// instead of the binary, and reloads templates when they change.
+	if v, ok := os.LookupEnv("DEV"); ok {
+		dev, _ = strconv.ParseBool(v)
+	}
 
 	var err error
-	if db, err = sql.Open("sqlite", "./db"); err != nil {
+
+	if v, ok := os.LookupEnv("PUBLIC_URL"); ok {
+		publicURL = strings.TrimSuffix(v, "/")
+	}
+
+	if v, ok := os.LookupEnv("RATE_LIMITS"); ok {
+		if err := parseRateLimits(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if v, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		if err := parseTrustedProxies(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if v, ok := os.LookupEnv("TRUSTED_PROXY_HEADER"); ok {
+		trustedProxyHeader = v
+	}
+
+	if err := initEmailCodeKey(os.Getenv("EMAIL_CODE_KEY")); err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+	if err := initCSRFKey(os.Getenv("CSRF_KEY")); err != nil {
+		log.Fatal(err)
+	}
+
+	if v, ok := os.LookupEnv("MAIL_FROM"); ok {
+		mailFrom = v
+	}
+
+	// SES_SNS_TOPIC_ARN turns on /ses-notifications/ for that topic only.
+	if v, ok := os.LookupEnv("SES_SNS_TOPIC_ARN"); ok {
+		sesTopicARN = v
+	}
+
+	if mailer, err = newMailer(context.Background(), os.Getenv("MAIL_BACKEND")); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := mailer.(*SESMailer); ok && sesTopicARN == "" {
+		slog.Warn("SES_SNS_TOPIC_ARN is not set, bounces and complaints won't be recorded")
+	}
+
+	bskyOAuth = newBskyOAuthClient(publicURL, os.Getenv("BSKY_PLC_URL"), dev)
+
+	if webAuthn, err = newWebAuthn(publicURL); err != nil {
 		log.Fatal(err)
 	}
-	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+
+	if v, ok := os.LookupEnv("TOKEN_ENCRYPTION_KEY"); ok {
+		c, err := newTokenCipher(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokenCipher = c
+	}
+
+	threadsOAuth = &ThreadsOAuthClient{
+		ClientID:     "23872373655703668",
+		ClientSecret: os.Getenv("THREADS_CLIENT_SECRET"),
+		RedirectURI:  publicURL + "/threads-auth/",
+		AuthorizeURL: "https://threads.net/oauth/authorize",
+		TokenURL:     "https://graph.threads.net/oauth/access_token",
+		GraphURL:     "https://graph.threads.net/v1.0",
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if v, ok := os.LookupEnv("THREADS_CLIENT_ID"); ok {
+		threadsOAuth.ClientID = v
+	}
+	if v, ok := os.LookupEnv("THREADS_REDIRECT_URI"); ok {
+		threadsOAuth.RedirectURI = v
+	}
+	if v, ok := os.LookupEnv("THREADS_AUTHORIZE_URL"); ok {
+		threadsOAuth.AuthorizeURL = v
+	}
+	if v, ok := os.LookupEnv("THREADS_TOKEN_URL"); ok {
+		threadsOAuth.TokenURL = v
+	}
+	if v, ok := os.LookupEnv("THREADS_GRAPH_URL"); ok {
+		threadsOAuth.GraphURL = v
+	}
+
+	// Pragmas go in the DSN so every pooled connection gets them, not just
+	// the first one. The driver is sqlite timing every statement, see
+	// metrics.go.
+	if db, err = sql.Open("sqlite-instrumented", "file:"+dbPath+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)"); err != nil {
 		log.Fatal(err)
 	}
-	if _, err := db.Exec("PRAGMA busy_timeout = 10000"); err != nil {
+	defer db.Close()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(context.Background(), os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := migrateLatest(context.Background()); err != nil {
 		log.Fatal(err)
 	}
 
-	sessionStmt, err = db.Prepare(`
-		SELECT
-		users.username,
-		email
-		FROM user_log_in_sessions
-		LEFT JOIN users ON user_log_in_sessions.username = users.username
-		WHERE id = ? 
-		LIMIT 1
-	`)
-	defer sessionStmt.Close()
-	if err != nil {
+	// ADMIN_USERNAMES bootstraps admins; the role is kept once granted.
+	if v, ok := os.LookupEnv("ADMIN_USERNAMES"); ok {
+		usernames := []string{}
+		for _, username := range strings.Split(v, ",") {
+			if username = strings.TrimSpace(username); username != "" {
+				usernames = append(usernames, username)
+			}
+		}
+		if err := grantRole(context.Background(), "admin", usernames); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := prepareSessionStmt(); err != nil {
 		log.Fatal(err)
 	}
+	defer sessionStmt.Close()
 
 	go func() {
 		ticker := time.NewTicker(time.Hour)
@@ -117,10 +234,18 @@ func main() {
 
 		for {
 			<-ticker.C
-			cutoff := time.Now().UTC().Add(-7 * 24 * time.Hour).Format(time.DateTime)
-			if _, err := db.Exec("DELETE FROM user_log_in_sessions WHERE created_at < ?", cutoff); err != nil {
-				log.Printf("delete user log in sessions failed: %v\n", err)
-				continue
+			ctx := backgroundContext()
+			now := time.Now().UTC().Format(time.DateTime)
+			if _, err := db.Exec("DELETE FROM user_log_in_sessions WHERE expires_at < ?", now); err != nil {
+				slog.ErrorContext(ctx, "delete user log in sessions failed", "err", err)
+			}
+			cutoff := time.Now().UTC().Add(-30 * 24 * time.Hour).Format(time.DateTime)
+			if _, err := db.Exec("DELETE FROM email_outbox WHERE status != 'pending' AND created_at < ?", cutoff); err != nil {
+				slog.ErrorContext(ctx, "delete email outbox failed", "err", err)
+			}
+			cutoff = time.Now().UTC().Add(-authEventRetention).Format(time.DateTime)
+			if _, err := db.Exec("DELETE FROM auth_events WHERE created_at < ?", cutoff); err != nil {
+				slog.ErrorContext(ctx, "delete auth events failed", "err", err)
 			}
 		}
 	}()
@@ -131,16 +256,32 @@ func main() {
 
 		for {
 			<-ticker.C
+			ctx := backgroundContext()
 			cutoff := time.Now().UTC().Add(-10 * time.Minute).Format(time.DateTime)
-			if _, err := db.Exec("DELETE FROM user_sign_up_email_tokens WHERE created_at < ?", cutoff); err != nil {
-				log.Printf("delete user sign up tokens failed: %v\n", err)
+			now := time.Now().UTC().Format(time.DateTime)
+			if _, err := db.Exec("DELETE FROM user_sign_up_email_tokens WHERE expires_at < ?", now); err != nil {
+				slog.ErrorContext(ctx, "delete user sign up tokens failed", "err", err)
+			}
+			if _, err := db.Exec("DELETE FROM user_log_in_email_tokens WHERE expires_at < ?", now); err != nil {
+				slog.ErrorContext(ctx, "delete user log in tokens failed", "err", err)
 			}
-			if _, err := db.Exec("DELETE FROM user_log_in_email_tokens WHERE created_at < ?", cutoff); err != nil {
-				log.Printf("delete user log in tokens failed: %v\n", err)
+			if _, err := db.Exec("DELETE FROM user_email_change_tokens WHERE expires_at < ?", now); err != nil {
+				slog.ErrorContext(ctx, "delete user email change tokens failed", "err", err)
+			}
+			if _, err := db.Exec("DELETE FROM email_code_lockouts WHERE locked_until < ?", now); err != nil {
+				slog.ErrorContext(ctx, "delete email code lockouts failed", "err", err)
+			}
+			if _, err := db.Exec("DELETE FROM bsky_oauth_requests WHERE created_at < ?", cutoff); err != nil {
+				slog.ErrorContext(ctx, "delete bsky oauth requests failed", "err", err)
+			}
+			if _, err := db.Exec("DELETE FROM passkey_ceremonies WHERE created_at < ?", cutoff); err != nil {
+				slog.ErrorContext(ctx, "delete passkey ceremonies failed", "err", err)
 			}
 		}
 	}()
 
+	go runOutbox(context.Background())
+
 	cursorFile, err := os.OpenFile("jetstream_cursor.txt", os.O_RDWR, 0600)
 	if err != nil {
 		log.Fatal(err)
@@ -194,18 +335,20 @@ func main() {
 		}
 		defer conn.Close()
 
+		// Each connection logs under its own request ID.
+		ctx := backgroundContext()
 		for {
 
 			evt := Event{}
 			err := conn.ReadJSON(&evt)
 			if err != nil {
-				log.Println(err)
+				slog.WarnContext(ctx, "read jetstream event failed", "err", err)
 				conn.Close()
 
 				for {
 					newConn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("wss://jetstream2.us-west.bsky.network/subscribe?wantedCollections=app.bsky.feed.post&cursor=%s", string(cursorBytes)), http.Header{})
 					if err != nil {
-						log.Println(err)
+						slog.WarnContext(ctx, "connect to jetstream failed", "err", err)
 						time.Sleep(5 * time.Second)
 						continue
 					}
@@ -213,6 +356,8 @@ func main() {
 					conn = newConn
 					break
 				}
+				jetstreamReconnects.Inc()
+				ctx = backgroundContext()
 
 				continue
 			}
@@ -221,10 +366,18 @@ func main() {
 			cursorBytes = []byte(strconv.FormatInt(evt.TimeUS, 10))
 			mux.Unlock()
 
+			// Identity and account events have no collection.
+			collection := evt.Commit.Collection
+			if collection == "" {
+				collection = evt.Kind
+			}
+			jetstreamEvents.WithLabelValues(collection).Inc()
+			jetstreamLag.Set(time.Since(time.UnixMicro(evt.TimeUS)).Seconds())
+
 			// TODO: use facet
 			if strings.Contains(evt.Commit.Record.Text, "#台灣人+1") {
 				if res, err := db.Query("SELECT * FROM bsky_feed_taiwanese_block_users WHERE did = ?", evt.DID); err != nil {
-					log.Println(err)
+					slog.ErrorContext(ctx, "check blocked user failed", "did", evt.DID, "err", err)
 					continue
 				} else if res.Next() {
 					continue
@@ -235,12 +388,12 @@ func main() {
 					VALUES (?)
 					ON CONFLICT DO NOTHING
 				`, evt.DID); err != nil {
-					log.Println(err)
+					slog.ErrorContext(ctx, "add Taiwanese user failed", "did", evt.DID, "err", err)
 					continue
 				}
 
 				usersSet[evt.DID] = struct{}{}
-				log.Printf("new Taiwanese: %s\n", evt.DID)
+				slog.InfoContext(ctx, "new Taiwanese", "did", evt.DID)
 			}
 
 			if _, ok := usersSet[evt.DID]; ok && evt.Commit.Record.Reply == nil {
@@ -253,11 +406,11 @@ func main() {
 					VALUES (?, ?, ?)
 					ON CONFLICT DO NOTHING
 				`, uri, evt.Commit.CID, createdAt); err != nil {
-						log.Println(err)
+						slog.ErrorContext(ctx, "add post failed", "uri", uri, "err", err)
 					}
 				case "delete":
 					if _, err := db.Exec("DELETE FROM bsky_feed_taiwanese_posts WHERE uri = ?", uri); err != nil {
-						log.Println(err)
+						slog.ErrorContext(ctx, "delete post failed", "uri", uri, "err", err)
 					}
 				}
 
@@ -265,26 +418,32 @@ func main() {
 		}
 	}()
 
-	tmpl = template.Must(template.New("base").Funcs(sprig.FuncMap()).ParseGlob("./template/*.tmpl"))
-	files, err := os.ReadDir("./page")
-	if err != nil {
+	minifier = minify.New()
+	minifier.AddFunc("text/html", html.Minify)
+	minifier.AddFunc("text/css", css.Minify)
+	minifier.AddFunc("image/svg+xml", svg.Minify)
+
+	if dev {
+		assetFS = os.DirFS(".")
+	}
+	if err := loadStaticAssets(); err != nil {
 		log.Fatal(err)
 	}
-
-	pageTmpl = map[string]*template.Template{}
-	for _, file := range files {
-		filename := file.Name()
-		pageTmpl[filename] = template.Must(template.Must(tmpl.Clone()).ParseFiles("./page/" + filename))
+	if err := checkVendorFiles(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTemplates(); err != nil {
+		log.Fatal(err)
+	}
+	if dev {
+		go watchAssets(context.Background())
 	}
-
-	minifier = minify.New()
-	minifier.AddFunc("text/html", html.Minify)
 
 	http.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
-		u, _, err := getSessionUser(r)
+		u, err := currentUser(r)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
@@ -294,7 +453,6 @@ func main() {
 	})
 
 	http.HandleFunc("GET /xrpc/app.bsky.feed.describeFeedGenerator", func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.URL.String())
 		w.Header().Set("Content-Type", "application/json")
 		m := map[string]any{
 			"did": "did:web:xn--kprw3s.tw",
@@ -308,11 +466,11 @@ func main() {
 	})
 
 	http.HandleFunc("GET /xrpc/app.bsky.feed.getFeedSkeleton", func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.URL.String())
+		start := time.Now()
 		query := r.URL.Query()
 		feed := query.Get("feed")
 		if feed != "at://did:plc:owthkwfcemjd2ydv42fvgsin/app.bsky.feed.generator/all-taiwanese" {
-			http.NotFound(w, r)
+			writeError(w, r, http.StatusNotFound)
 			return
 		}
 
@@ -321,15 +479,18 @@ func main() {
 		if len(limitStr) > 0 {
 			l, err := strconv.Atoi(limitStr)
 			if err != nil {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest)
 				return
 			} else if l < 1 || l > 100 {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest)
 				return
 			}
 
 			limit = l
 		}
+		defer func() {
+			feedSkeletonDuration.WithLabelValues(strconv.Itoa(limit)).Observe(time.Since(start).Seconds())
+		}()
 
 		createdAt := ""
 		cid := ""
@@ -337,14 +498,13 @@ func main() {
 		if len(cursor) > 0 {
 			parts := strings.Split(cursor, "::")
 			if len(parts) != 2 {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				writeError(w, r, http.StatusBadRequest)
 				return
 			}
 
 			createdAt, cid = parts[0], parts[1]
 		}
 
-		log.Println(createdAt, cid)
 		var rows *sql.Rows
 		if createdAt != "" && cid != "" {
 			rows, err = db.Query(`
@@ -361,8 +521,8 @@ func main() {
 		`, limit)
 		}
 		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
@@ -372,8 +532,8 @@ func main() {
 		for rows.Next() {
 			uri := ""
 			if err := rows.Scan(&uri, &lastCreatedAt, &lastCid); err != nil {
-				log.Println(err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
 				return
 			}
 			feeds = append(feeds, map[string]string{
@@ -395,7 +555,6 @@ func main() {
 	})
 
 	http.HandleFunc("GET /.well-known/did.json", func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.URL.String())
 		m := map[string]any{
 			"@context": []string{"https://www.w3.org/ns/did/v1"},
 			"id":       "did:web:xn--kprw3s.tw",
@@ -419,8 +578,8 @@ func main() {
 			ORDER BY created_at DESC, did
 		`)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
@@ -429,8 +588,8 @@ func main() {
 		for rows.Next() {
 			did := ""
 			if rows.Scan(&did); err != nil {
-				log.Println(err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
 				return
 			}
 
@@ -447,10 +606,10 @@ func main() {
 
 		}
 
-		eg, _ := errgroup.WithContext(r.Context())
+		eg, ctx := errgroup.WithContext(r.Context())
 		eg.SetLimit(10)
 		if len(unpopulatedProfiles) > 0 {
-			log.Println(len(unpopulatedProfiles))
+			slog.DebugContext(ctx, "fetch bsky profiles", "count", len(unpopulatedProfiles))
 			for i := 0; i < len(unpopulatedProfiles); i += 25 {
 				start := i
 				var end = i + 25
@@ -465,13 +624,13 @@ func main() {
 
 					res, err := http.Get("https://public.api.bsky.app/xrpc/app.bsky.actor.getProfiles?" + strings.Join(actors, "&"))
 					if err != nil {
-						log.Println(err)
+						slog.WarnContext(ctx, "get bsky profiles failed", "err", err)
 						return err
 					}
 
 					r := map[string][]BskyUserProfile{}
 					if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-						log.Println(err)
+						slog.WarnContext(ctx, "decode bsky profiles failed", "err", err)
 						return err
 					}
 					res.Body.Close()
@@ -491,8 +650,8 @@ func main() {
 		}
 
 		if err := eg.Wait(); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
@@ -508,109 +667,139 @@ func main() {
 	})
 
 	http.HandleFunc("GET /sign-up/{$}", func(w http.ResponseWriter, r *http.Request) {
-		if _, ok, err := getSessionUser(r); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if u, err := currentUser(r); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
-		} else if ok {
+		} else if u != nil {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
 
-		executePage(w, r, "sign-up.tmpl", nil)
+		executePage(w, r, "sign-up.tmpl", map[string]any{
+			"form": Form{},
+		})
 	})
 
-	http.HandleFunc("POST /sign-up-by-email/{$}", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("POST /sign-up-by-email/{$}", rateLimit("sign-up-by-email", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		username := r.FormValue("username")
-		email := r.FormValue("email")
+		email, emailError := normalizeEmail(r.FormValue("email"))
+
+		form := Form{Values: r.PostForm, Errors: FieldErrors{}}
+		if msg := validateUsername(username); msg != "" {
+			form.Errors["username"] = msg
+		}
+		if emailError != "" {
+			form.Errors["email"] = emailError
+		}
+		if len(form.Errors) != 0 {
+			writeFormErrors(w, r, "sign-up-form", "sign-up-form", form)
+			return
+		}
 
-		// add validation
 		rows, err := db.Query(`
-			SELECT username, email
+			SELECT username, COALESCE(email, '')
 			FROM users
-			WHERE username = ? OR email = ?
+			WHERE username = ? COLLATE NOCASE OR email = ?
 			`, username, email)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 		defer rows.Close()
 
-		conflictFields := []string{}
 		for rows.Next() {
 			var u, e string
-			rows.Scan(&u, &e)
-			if u == username {
-				conflictFields = append(conflictFields, "username")
+			if err := rows.Scan(&u, &e); err != nil {
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+			if strings.EqualFold(u, username) {
+				form.Errors["username"] = "form.username-taken"
 			}
 			if e == email {
-				conflictFields = append(conflictFields, "email")
+				form.Errors["email"] = "form.email-taken"
 			}
 		}
-		if len(conflictFields) != 0 {
-			http.Error(w, strings.Join(conflictFields, ","), http.StatusConflict)
+		if len(form.Errors) != 0 {
+			writeFormErrors(w, r, "sign-up-form", "sign-up-form", form)
 			return
 		}
 
-		sixDigits := mrand.Intn(900000) + 100000
-		token := strconv.FormatInt(int64(sixDigits), 10)
-		if _, err := db.Exec(`
-			INSERT INTO user_sign_up_email_tokens (username, email, token) 
-			VALUES (?, ?, ?) 
-			ON CONFLICT DO UPDATE SET token = ?
-			`, username, email, token, token); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if err := checkEmailLockout(db, email); errors.Is(err, errEmailCodeLocked) {
+			writeErrorMessage(w, r, http.StatusTooManyRequests, "common.code-locked")
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := checkEmailSuppressed(r.Context(), email); errors.Is(err, errEmailSuppressed) {
+			form.Errors["email"] = "form.email-suppressed"
+			writeFormErrors(w, r, "sign-up-form", "sign-up-form", form)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		ctx := r.Context()
-		cfg, err := config.LoadDefaultConfig(ctx)
+		token, err := newEmailCode()
 		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		title := "信箱驗證碼"
-		from := "台島 <no-reply@xn--kprw3s.tw>"
-		var htmlBuffer bytes.Buffer
-		if err = tmpl.ExecuteTemplate(&htmlBuffer, "sign-up-email", token); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		tx, err := db.Begin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
 		}
-		body := htmlBuffer.String()
+		defer tx.Rollback()
 
-		client := ses.NewFromConfig(cfg)
-		client.SendEmail(ctx, &ses.SendEmailInput{
-			Destination: &types.Destination{
-				ToAddresses: []string{email},
-			},
-			Message: &types.Message{
-				Subject: &types.Content{
-					Data: &title,
-				},
-				Body: &types.Body{
-					Html: &types.Content{
-						Data: &body,
-					},
-				},
-			},
-			Source: &from,
-		})
+		// A new code replaces any pending one for the same username or email.
+		if _, err := tx.Exec("DELETE FROM user_sign_up_email_tokens WHERE username = ? OR email = ?", username, email); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO user_sign_up_email_tokens (username, email, token_hash, expires_at) 
+			VALUES (?, ?, ?, ?) 
+			`, username, email, hashEmailCode(email, token), emailCodeExpiry()); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := queueEmailCode(r.Context(), tx, "sign-up-code", emailLocale(r, ""), email, EmailCodeData{Code: token}); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		wakeOutbox()
+		recordAuthEvent(r, authEventSignUpRequested, "", email, username)
+		recordAuthEvent(r, authEventCodeSent, "", email, "sign-up")
 
 		w.Header().Add("HX-Redirect", fmt.Sprintf("/verify-sign-up-email/?username=%s&email=%s", url.QueryEscape(username), url.QueryEscape(email)))
 		w.WriteHeader(http.StatusSeeOther)
-	})
+	}))
 
 	http.HandleFunc("GET /verify-sign-up-email/{$}", func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query()
 		username := query.Get("username")
 		email := query.Get("email")
 		if email == "" || username == "" {
-			http.NotFound(w, r)
+			writeError(w, r, http.StatusNotFound)
 			return
 		}
 		executePage(w, r, "verify-sign-up-email.tmpl", map[string]any{
@@ -619,182 +808,194 @@ func main() {
 		})
 	})
 
-	http.HandleFunc("POST /verify-sign-up-email/{$}", rateLimit(1, 10, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("POST /verify-sign-up-email/{$}", rateLimit("verify-sign-up-email", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
-		username := r.FormValue("username")
 		email := r.FormValue("email")
 		token := r.FormValue("token")
 
-		var count int
-		if db.QueryRow(`
-			SELECT COUNT() FROM user_sign_up_email_tokens
-			WHERE username = ?
-			AND email = ?
-			AND token = ?
-		`, username, email, token).Scan(&count) == sql.ErrNoRows || count == 0 {
-			http.NotFound(w, r)
+		tx, err := db.Begin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		tx, err := db.Begin()
-		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		var username string
+		if err := tx.QueryRow("SELECT username FROM user_sign_up_email_tokens WHERE email = ?", email).Scan(&username); errors.Is(err, sql.ErrNoRows) {
+			tx.Rollback()
+			writeErrorMessage(w, r, http.StatusNotFound, "common.code-wrong")
+			return
+		} else if err != nil {
+			tx.Rollback()
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		if err := consumeEmailCode(tx, "user_sign_up_email_tokens", email, token); err != nil {
+			if err := tx.Commit(); err != nil {
+				slog.ErrorContext(r.Context(), "commit email code attempt failed", "err", err)
+			}
+			recordCodeFailure(r, "sign-up", "", email, err)
+			writeEmailCodeError(w, r, "sign-up", err)
 			return
 		}
 
-		if res, err := tx.Exec("INSERT INTO users (username, email) VALUES (?, ?)", username, email); err != nil {
+		// Someone may have taken the username or email since the code was
+		// sent. Usernames are compared regardless of case, which the primary
+		// key doesn't do.
+		if res, err := tx.Exec(`
+			INSERT INTO users (username, email)
+			SELECT ?, ?
+			WHERE NOT EXISTS (SELECT 1 FROM users WHERE username = ? COLLATE NOCASE OR email = ?)
+			ON CONFLICT DO NOTHING
+		`, username, email, username, email); err != nil {
 			tx.Rollback()
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		} else if affected, err := res.RowsAffected(); err != nil {
 			tx.Rollback()
-			log.Println("res.RowsAffected failed in verify-sign-up-email")
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		} else if affected == 0 {
 			tx.Rollback()
-			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
-			return
-		}
-		if _, err := tx.Exec("DELETE FROM user_sign_up_email_tokens WHERE username = ? AND email = ?", username, email); err != nil {
-			tx.Rollback()
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			writeError(w, r, http.StatusConflict)
 			return
 		}
 		if err := tx.Commit(); err != nil {
 			tx.Rollback()
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		bs := make([]byte, 32)
-		if _, err = crand.Read(bs); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		}
-		sessionId := base64.URLEncoding.EncodeToString(bs)
+		recordAuthEvent(r, authEventCodeVerified, username, email, "sign-up")
+		recordAuthEvent(r, authEventSignUp, username, email, "email")
 
-		if _, err := db.Exec(`
-			INSERT INTO user_log_in_sessions (id, username) 
-			VALUES (?, ?)
-		`, sessionId, username); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if err := startSession(w, r, username); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
+		recordAuthEvent(r, authEventLogIn, username, email, "email")
 
-		cookie := http.Cookie{
-			Name:  "session",
-			Value: sessionId,
-			Path:  "/", Expires: time.Now().Add(7 * 24 * time.Hour),
-			HttpOnly: true,
-			Secure:   true,
-		}
-
-		http.SetCookie(w, &cookie)
 		w.Header().Add("HX-Redirect", "/")
 		w.WriteHeader(http.StatusSeeOther)
 	}))
 
 	http.HandleFunc("GET /log-in/{$}", func(w http.ResponseWriter, r *http.Request) {
-		if _, ok, err := getSessionUser(r); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if u, err := currentUser(r); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
-		} else if ok {
+		} else if u != nil {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
 
-		executePage(w, r, "log-in.tmpl", nil)
+		executePage(w, r, "log-in.tmpl", map[string]any{
+			"form": Form{},
+		})
 	})
 
+	// The email form is on the log in page.
 	http.HandleFunc("GET /log-in-by-email/{$}", func(w http.ResponseWriter, r *http.Request) {
-		if _, ok, err := getSessionUser(r); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		} else if ok {
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
-
-		executePage(w, r, "log-in-by-email.tmpl", nil)
+		http.Redirect(w, r, "/log-in/", http.StatusFound)
 	})
 
-	http.HandleFunc("POST /log-in-by-email/{$}", rateLimit(1, 10, func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("POST /log-in-by-email/{$}", rateLimit("log-in-by-email", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
-		email := r.FormValue("email")
+		email, emailError := normalizeEmail(r.FormValue("email"))
 
-		var username string
-		if err := db.QueryRow("SELECT username FROM users WHERE email = ?", email).Scan(&username); errors.Is(err, sql.ErrNoRows) {
-			http.NotFound(w, r)
+		form := Form{Values: r.PostForm, Errors: FieldErrors{}}
+		if emailError != "" {
+			form.Errors["email"] = emailError
+			writeFormErrors(w, r, "log-in-email-form", "log-in-email-form", form)
+			return
+		}
+
+		var username, locale string
+		if err := db.QueryRow("SELECT username, COALESCE(locale, '') FROM users WHERE email = ?", email).Scan(&username, &locale); errors.Is(err, sql.ErrNoRows) {
+			writeErrorMessage(w, r, http.StatusNotFound, "log-in.email-not-found")
 			return
 		} else if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		sixDigits := mrand.Intn(900000) + 100000
-		token := strconv.FormatInt(int64(sixDigits), 10)
-		if _, err := db.Exec(`
-			INSERT INTO user_log_in_email_tokens (email, token) 
-			VALUES (?, ?)
-		`, email, token); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if err := checkEmailLockout(db, email); errors.Is(err, errEmailCodeLocked) {
+			writeErrorMessage(w, r, http.StatusTooManyRequests, "common.code-locked")
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := checkEmailSuppressed(r.Context(), email); errors.Is(err, errEmailSuppressed) {
+			form.Errors["email"] = "form.email-suppressed"
+			writeFormErrors(w, r, "log-in-email-form", "log-in-email-form", form)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		ctx := r.Context()
-		cfg, err := config.LoadDefaultConfig(ctx)
+		token, err := newEmailCode()
 		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		title := "信箱驗證碼"
-		from := "台島 <no-reply@xn--kprw3s.tw>"
-		var htmlBuffer bytes.Buffer
-		if err = tmpl.ExecuteTemplate(&htmlBuffer, "sign-up-email", token); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		tx, err := db.Begin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
 		}
-		body := htmlBuffer.String()
-
-		client := ses.NewFromConfig(cfg)
-		client.SendEmail(ctx, &ses.SendEmailInput{
-			Destination: &types.Destination{
-				ToAddresses: []string{email},
-			},
-			Message: &types.Message{
-				Subject: &types.Content{
-					Data: &title,
-				},
-				Body: &types.Body{
-					Html: &types.Content{
-						Data: &body,
-					},
-				},
-			},
-			Source: &from,
-		})
+		defer tx.Rollback()
+
+		// A new code replaces any pending one for the same email.
+		if _, err := tx.Exec(`
+			INSERT INTO user_log_in_email_tokens (email, token_hash, expires_at) 
+			VALUES (?, ?, ?)
+			ON CONFLICT DO UPDATE SET
+			token_hash = excluded.token_hash,
+			attempts = 0,
+			expires_at = excluded.expires_at,
+			created_at = CURRENT_TIMESTAMP
+		`, email, hashEmailCode(email, token), emailCodeExpiry()); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := queueEmailCode(r.Context(), tx, "log-in-code", emailLocale(r, locale), email, EmailCodeData{Code: token}); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		wakeOutbox()
+		recordAuthEvent(r, authEventCodeSent, username, email, "log-in")
 
 		w.Header().Add("HX-Redirect", fmt.Sprintf("/verify-log-in-email/?email=%s", url.QueryEscape(email)))
 		w.WriteHeader(http.StatusSeeOther)
 	}))
 
 	http.HandleFunc("GET /verify-log-in-email/{$}", func(w http.ResponseWriter, r *http.Request) {
-		if _, ok, err := getSessionUser(r); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if u, err := currentUser(r); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
-		} else if ok {
+		} else if u != nil {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
@@ -802,7 +1003,7 @@ func main() {
 		query := r.URL.Query()
 		email := query.Get("email")
 		if email == "" {
-			http.NotFound(w, r)
+			writeError(w, r, http.StatusNotFound)
 			return
 		}
 
@@ -811,144 +1012,1030 @@ func main() {
 		})
 	})
 
-	http.HandleFunc("POST /verify-log-in-email/{$}", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("POST /verify-log-in-email/{$}", rateLimit("verify-log-in-email", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		email := r.FormValue("email")
 		token := r.FormValue("token")
 
-		var username string
-		if db.QueryRow(`
-			SELECT username 
-			FROM user_log_in_email_tokens
-			LEFT JOIN users ON user_log_in_email_tokens.email = users.email
-			WHERE user_log_in_email_tokens.email = ?
-			AND token = ?
-		`, email, token).Scan(&username) == sql.ErrNoRows {
-			http.NotFound(w, r)
+		tx, err := db.Begin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		if _, err := db.Exec("DELETE FROM user_log_in_email_tokens WHERE email = ? AND token = ?", email, token); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if err := consumeEmailCode(tx, "user_log_in_email_tokens", email, token); err != nil {
+			if err := tx.Commit(); err != nil {
+				slog.ErrorContext(r.Context(), "commit email code attempt failed", "err", err)
+			}
+			recordCodeFailure(r, "log-in", "", email, err)
+			writeEmailCodeError(w, r, "log-in", err)
 			return
 		}
 
-		bs := make([]byte, 32)
-		if _, err = crand.Read(bs); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		var username string
+		if err := tx.QueryRow("SELECT username FROM users WHERE email = ?", email).Scan(&username); errors.Is(err, sql.ErrNoRows) {
+			tx.Rollback()
+			writeError(w, r, http.StatusNotFound)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
 		}
-		sessionId := base64.URLEncoding.EncodeToString(bs)
 
-		if _, err := db.Exec(`
-			INSERT INTO user_log_in_sessions (id, username) 
-			VALUES (?, ?)
-		`, sessionId, username); err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if err := tx.Commit(); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
 		}
 
-		cookie := http.Cookie{
-			Name:  "session",
-			Value: sessionId,
-			Path:  "/", Expires: time.Now().Add(7 * 24 * time.Hour),
-			HttpOnly: true,
-			Secure:   true,
+		recordAuthEvent(r, authEventCodeVerified, username, email, "log-in")
+
+		if err := startSession(w, r, username); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
 		}
+		recordAuthEvent(r, authEventLogIn, username, email, "email")
 
-		http.SetCookie(w, &cookie)
 		w.Header().Add("HX-Redirect", "/")
 		w.WriteHeader(http.StatusSeeOther)
+	}))
+
+	http.HandleFunc("GET /oauth-client-metadata.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bskyOAuth.ClientMetadata())
 	})
 
-	http.HandleFunc("POST /log-out/{$}", func(w http.ResponseWriter, r *http.Request) {
-		u, ok, err := getSessionUser(r)
+	http.HandleFunc("POST /log-in-by-bsky/{$}", rateLimit("log-in-by-bsky", func(w http.ResponseWriter, r *http.Request) {
+		u, err := currentUser(r)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
 			return
-		} else if ok {
-			db.Exec("DELETE FROM user_log_in_sessions WHERE username = ?", u.Username)
 		}
 
-		w.Header().Add("HX-Redirect", "/")
-		w.WriteHeader(http.StatusSeeOther)
-	})
-
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServerFS(os.DirFS("static"))))
+		linkUsername := ""
+		if u != nil {
+			linkUsername = u.Username
+		}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
-	}
-}
+		r.ParseForm()
+		authURL, state, err := bskyOAuth.StartAuthorization(r.Context(), r.FormValue("handle"), linkUsername)
+		if errors.Is(err, errBskyAccountNotFound) {
+			writeErrorMessage(w, r, http.StatusNotFound, "log-in.bsky-not-found")
+			return
+		} else if err != nil {
+			slog.WarnContext(r.Context(), "request rejected", "err", err)
+			writeErrorMessage(w, r, http.StatusBadGateway, "log-in.bsky-failed")
+			return
+		}
 
-func executePage(w http.ResponseWriter, r *http.Request, name string, data any) {
-	var writer io.Writer = w
+		setBskyStateCookie(w, state)
+		w.Header().Add("HX-Redirect", authURL)
+		w.WriteHeader(http.StatusSeeOther)
+	}))
 
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		w.Header().Set("Content-Encoding", "gzip")
-		gzipWriter := gzip.NewWriter(w)
-		defer gzipWriter.Close()
+	http.HandleFunc("GET /bsky-oauth-callback/{$}", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		query := r.URL.Query()
 
-		writer = gzipWriter
-	}
+		cookie, err := r.Cookie("bsky_state")
+		setBskyStateCookie(w, "")
+		if err != nil || query.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
 
-	minifyWriter := minifier.Writer("text/html", writer)
-	defer minifyWriter.Close()
+		result, err := bskyOAuth.FinishAuthorization(ctx, query)
+		if err != nil {
+			slog.WarnContext(r.Context(), "request rejected", "err", err)
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
 
-	page := pageTmpl[name]
-	if err := page.ExecuteTemplate(minifyWriter, "page", data); err != nil {
-		log.Println(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-}
+		var username string
+		err = db.QueryRowContext(ctx, "SELECT username FROM user_bsky_identities WHERE did = ?", result.DID).Scan(&username)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		linked := err == nil
 
-func executeTemplates(w http.ResponseWriter, data any, trigger string, names ...string) {
-	minifyWriter := minifier.Writer("text/html", w)
-	defer minifyWriter.Close()
+		if result.LinkUsername != "" {
+			// Linking to the account that started the flow.
+			if u, err := currentUser(r); err != nil {
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			} else if u == nil || u.Username != result.LinkUsername {
+				writeError(w, r, http.StatusForbidden)
+				return
+			}
 
-	if len(trigger) > 0 {
-		w.Header().Add("HX-Trigger", trigger)
+			if linked && username != result.LinkUsername {
+				writeError(w, r, http.StatusConflict)
+				return
+			} else if !linked {
+				if _, err := db.ExecContext(ctx, `
+					INSERT INTO user_bsky_identities (did, username, handle)
+					VALUES (?, ?, ?)
+				`, result.DID, result.LinkUsername, result.Handle); err != nil {
+					slog.ErrorContext(r.Context(), "request failed", "err", err)
+					writeError(w, r, http.StatusInternalServerError)
+					return
+				}
+				recordAuthEvent(r, authEventIdentityLinked, result.LinkUsername, "", "bsky "+result.DID)
+			}
+
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if linked {
+			if _, err := db.ExecContext(ctx, "UPDATE user_bsky_identities SET handle = ? WHERE did = ?", result.Handle, result.DID); err != nil {
+				slog.ErrorContext(ctx, "update bsky handle failed", "err", err)
+			}
+		} else {
+			username, err = createUser(ctx, bskyUsername(result.Handle), func(tx *sql.Tx, username string) error {
+				_, err := tx.Exec(`
+					INSERT INTO user_bsky_identities (did, username, handle)
+					VALUES (?, ?, ?)
+				`, result.DID, username, result.Handle)
+				return err
+			})
+			if err != nil {
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+			recordAuthEvent(r, authEventSignUp, username, "", "bsky "+result.DID)
+		}
+
+		if err := startSession(w, r, username); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		recordAuthEvent(r, authEventLogIn, username, "", "bsky")
+
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+
+	http.HandleFunc("GET /log-in-by-threads/{$}", func(w http.ResponseWriter, r *http.Request) {
+		if threadsOAuth.ClientSecret == "" || tokenCipher == nil {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+
+		state := randomToken(24)
+		setThreadsStateCookie(w, state)
+		http.Redirect(w, r, threadsOAuth.AuthCodeURL(state), http.StatusFound)
+	})
+
+	http.HandleFunc("GET /threads-auth/{$}", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		query := r.URL.Query()
+
+		cookie, err := r.Cookie("threads_state")
+		setThreadsStateCookie(w, "")
+		if err != nil || query.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		if query.Get("error") != "" {
+			http.Redirect(w, r, "/log-in/", http.StatusFound)
+			return
+		}
+
+		token, err := threadsOAuth.Exchange(ctx, query.Get("code"))
+		if err != nil {
+			slog.WarnContext(r.Context(), "request rejected", "err", err)
+			writeError(w, r, http.StatusBadGateway)
+			return
+		}
+		threadsUserID := token.UserID.String()
+
+		encryptedToken, err := encryptToken(token.AccessToken)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		var username string
+		err = db.QueryRowContext(ctx, "SELECT username FROM user_threads_identities WHERE threads_user_id = ?", threadsUserID).Scan(&username)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		linked := err == nil
+
+		u, err := currentUser(r)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		ok := u != nil
+
+		if ok && linked && username != u.Username {
+			writeError(w, r, http.StatusConflict)
+			return
+		}
+
+		if linked || ok {
+			if !linked {
+				username = u.Username
+			}
+
+			if _, err := db.ExecContext(ctx, `
+				INSERT INTO user_threads_identities (threads_user_id, username, access_token)
+				VALUES (?, ?, ?)
+				ON CONFLICT DO UPDATE SET access_token = excluded.access_token
+			`, threadsUserID, username, encryptedToken); err != nil {
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+			if !linked {
+				recordAuthEvent(r, authEventIdentityLinked, username, "", "threads "+threadsUserID)
+			}
+		} else {
+			threadsUsername, err := threadsOAuth.Username(ctx, token.AccessToken)
+			if err != nil {
+				slog.WarnContext(ctx, "get threads username failed", "err", err)
+				threadsUsername = "threads"
+			}
+
+			username, err = createUser(ctx, threadsUsername, func(tx *sql.Tx, username string) error {
+				_, err := tx.Exec(`
+					INSERT INTO user_threads_identities (threads_user_id, username, access_token)
+					VALUES (?, ?, ?)
+				`, threadsUserID, username, encryptedToken)
+				return err
+			})
+			if err != nil {
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+			recordAuthEvent(r, authEventSignUp, username, "", "threads "+threadsUserID)
+		}
+
+		if !ok {
+			if err := startSession(w, r, username); err != nil {
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+			recordAuthEvent(r, authEventLogIn, username, "", "threads")
+		}
+
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+
+	http.HandleFunc("GET /passkeys/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		passkeys, err := listPasskeys(r.Context(), u.Username)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		executePage(w, r, "passkeys.tmpl", map[string]any{
+			"user":     u,
+			"passkeys": passkeys,
+		})
+	}))
+
+	http.HandleFunc("POST /passkeys/register/begin/{$}", rateLimit("register-passkey", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		ctx := r.Context()
+		pu, err := getPasskeyUser(ctx, u.Username)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		creation, session, err := webAuthn.BeginRegistration(pu, webauthn.WithExclusions(webauthn.Credentials(pu.Credentials).CredentialDescriptors()))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		if err := saveCeremony(ctx, w, u.Username, session); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(creation)
+	})))
+
+	http.HandleFunc("POST /passkeys/register/finish/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		ctx := r.Context()
+		session, err := takeCeremony(ctx, r, u.Username)
+		if err != nil {
+			slog.WarnContext(r.Context(), "request rejected", "err", err)
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		pu, err := getPasskeyUser(ctx, u.Username)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		credential, err := webAuthn.FinishRegistration(pu, *session, r)
+		if err != nil {
+			slog.WarnContext(r.Context(), "request rejected", "err", err)
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		if name == "" || len(name) > 64 {
+			name = translate(siteLocale(r), "passkeys.default-name")
+		}
+
+		if err := savePasskey(ctx, u.Username, name, credential); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		recordAuthEvent(r, authEventPasskeyAdded, u.Username, "", name)
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	http.HandleFunc("DELETE /passkeys/{id}/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		if deleted, err := deletePasskey(r.Context(), u.Username, r.PathValue("id")); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		} else if !deleted {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+		recordAuthEvent(r, authEventPasskeyRemoved, u.Username, "", r.PathValue("id"))
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	http.HandleFunc("POST /log-in-by-passkey/begin/{$}", rateLimit("log-in-by-passkey", func(w http.ResponseWriter, r *http.Request) {
+		assertion, session, err := webAuthn.BeginDiscoverableLogin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		if err := saveCeremony(r.Context(), w, "", session); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assertion)
+	}))
+
+	http.HandleFunc("POST /log-in-by-passkey/finish/{$}", rateLimit("log-in-by-passkey", func(w http.ResponseWriter, r *http.Request) {
+		session, err := takeCeremony(r.Context(), r, "")
+		if err != nil {
+			slog.WarnContext(r.Context(), "request rejected", "err", err)
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		username, err := passkeyLogIn(r, session)
+		if err != nil {
+			slog.WarnContext(r.Context(), "passkey log in failed", "err", err)
+			recordAuthEvent(r, authEventLogInFailed, "", "", "passkey")
+			writeError(w, r, http.StatusUnauthorized)
+			return
+		}
+
+		if err := startSession(w, r, username); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		recordAuthEvent(r, authEventLogIn, username, "", "passkey")
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	http.HandleFunc("POST /log-out/{$}", func(w http.ResponseWriter, r *http.Request) {
+		u, err := currentUser(r)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		if err := endSession(w, r); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if u != nil {
+			recordAuthEvent(r, authEventLogOut, u.Username, "", "")
+		}
+
+		w.Header().Add("HX-Redirect", "/")
+		w.WriteHeader(http.StatusSeeOther)
+	})
+
+	http.HandleFunc("GET /account/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		sessions, err := listSessions(r.Context(), r, u.Username)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		events, err := listAuthEvents(r.Context(), AuthEventFilter{Username: u.Username, Limit: 20})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		executePage(w, r, "account.tmpl", map[string]any{
+			"user":         u,
+			"sessions":     sessions,
+			"events":       events,
+			"usernameForm": Form{Values: url.Values{"username": {u.Username}}},
+			"emailForm":    Form{},
+		})
+	}))
+
+	http.HandleFunc("POST /locale/{$}", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		locale := r.FormValue("locale")
+		if locale != "" && !slices.Contains(siteLocales, locale) {
+			writeError(w, r, http.StatusBadRequest)
+			return
+		}
+
+		u, err := currentUser(r)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if u != nil {
+			if _, err := db.Exec("UPDATE users SET locale = ? WHERE username = ?", nullString(locale), u.Username); err != nil {
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		setLocaleCookie(w, locale)
+		w.Header().Set("HX-Refresh", "true")
+	})
+
+	http.HandleFunc("POST /account/username/{$}", rateLimit("change-username", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		r.ParseForm()
+		username := r.FormValue("username")
+
+		form := Form{Values: r.PostForm, Errors: FieldErrors{}}
+		if msg := validateUsername(username); msg != "" {
+			form.Errors["username"] = msg
+			writeFormErrors(w, r, "account-username-form", "account-username-form", form)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Changing only the case of one's own username is allowed.
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? COLLATE NOCASE AND username != ?)", username, u.Username).Scan(&taken); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		} else if taken {
+			form.Errors["username"] = "form.username-taken"
+			writeFormErrors(w, r, "account-username-form", "account-username-form", form)
+			return
+		}
+
+		// Sessions, passkeys and identities follow through ON UPDATE CASCADE.
+		if _, err := tx.Exec("UPDATE users SET username = ? WHERE username = ?", username, u.Username); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if username != u.Username {
+			recordAuthEvent(r, authEventUsernameChanged, username, "", u.Username+" → "+username)
+		}
+
+		w.Header().Add("HX-Redirect", "/account/")
+		w.WriteHeader(http.StatusSeeOther)
+	})))
+
+	http.HandleFunc("POST /account/email/{$}", rateLimit("change-email", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		r.ParseForm()
+		email, emailError := normalizeEmail(r.FormValue("email"))
+
+		form := Form{Values: r.PostForm, Errors: FieldErrors{}}
+		if emailError != "" {
+			form.Errors["email"] = emailError
+			writeFormErrors(w, r, "account-email-form", "account-email-form", form)
+			return
+		}
+
+		var taken bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", email).Scan(&taken); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		} else if taken {
+			form.Errors["email"] = "form.email-taken"
+			writeFormErrors(w, r, "account-email-form", "account-email-form", form)
+			return
+		}
+
+		if err := checkEmailLockout(db, email); errors.Is(err, errEmailCodeLocked) {
+			writeErrorMessage(w, r, http.StatusTooManyRequests, "common.code-locked")
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := checkEmailSuppressed(r.Context(), email); errors.Is(err, errEmailSuppressed) {
+			form.Errors["email"] = "form.email-suppressed"
+			writeFormErrors(w, r, "account-email-form", "account-email-form", form)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		token, err := newEmailCode()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// A new code replaces any pending change for the same user or email.
+		if _, err := tx.Exec("DELETE FROM user_email_change_tokens WHERE username = ? OR email = ?", u.Username, email); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO user_email_change_tokens (email, username, token_hash, expires_at)
+			VALUES (?, ?, ?, ?)
+		`, email, u.Username, hashEmailCode(email, token), emailCodeExpiry()); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := queueEmailCode(r.Context(), tx, "email-change-code", emailLocale(r, u.Locale), email, EmailCodeData{Username: u.Username, Code: token}); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		wakeOutbox()
+		recordAuthEvent(r, authEventEmailChangeRequested, u.Username, email, "")
+		recordAuthEvent(r, authEventCodeSent, u.Username, email, "email-change")
+
+		w.Header().Add("HX-Redirect", fmt.Sprintf("/account/verify-email/?email=%s", url.QueryEscape(email)))
+		w.WriteHeader(http.StatusSeeOther)
+	})))
+
+	http.HandleFunc("GET /account/verify-email/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+
+		executePage(w, r, "verify-email-change.tmpl", map[string]any{
+			"email": email,
+		})
+	}))
+
+	http.HandleFunc("POST /account/verify-email/{$}", rateLimit("verify-email-change", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		r.ParseForm()
+		email := r.FormValue("email")
+		token := r.FormValue("token")
+
+		tx, err := db.Begin()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		// Only the user who asked for the change can confirm it.
+		var owner string
+		if err := tx.QueryRow("SELECT username FROM user_email_change_tokens WHERE email = ?", email).Scan(&owner); errors.Is(err, sql.ErrNoRows) {
+			tx.Rollback()
+			writeError(w, r, http.StatusNotFound)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		} else if owner != u.Username {
+			tx.Rollback()
+			writeErrorMessage(w, r, http.StatusNotFound, "common.code-wrong")
+			return
+		}
+
+		if err := consumeEmailCode(tx, "user_email_change_tokens", email, token); err != nil {
+			if err := tx.Commit(); err != nil {
+				slog.ErrorContext(r.Context(), "commit email code attempt failed", "err", err)
+			}
+			recordCodeFailure(r, "email-change", u.Username, email, err)
+			writeEmailCodeError(w, r, "email-change", err)
+			return
+		}
+
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", email).Scan(&taken); err != nil {
+			tx.Rollback()
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		} else if taken {
+			tx.Rollback()
+			writeErrorMessage(w, r, http.StatusConflict, "verify-email-change.taken")
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE users SET email = ? WHERE username = ?", email, u.Username); err != nil {
+			tx.Rollback()
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		if u.Email != "" {
+			// Codes already sent to the old address stop working.
+			if _, err := tx.Exec("DELETE FROM user_log_in_email_tokens WHERE email = ?", u.Email); err != nil {
+				tx.Rollback()
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+
+			msg, err := renderEmail("email-changed", emailLocale(r, u.Locale), u.Email, EmailChangedData{
+				Username: u.Username,
+				NewEmail: maskEmail(email),
+			})
+			if err == nil {
+				err = enqueueEmail(r.Context(), tx, msg, time.Time{})
+			}
+			if err != nil {
+				tx.Rollback()
+				slog.ErrorContext(r.Context(), "request failed", "err", err)
+				writeError(w, r, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		wakeOutbox()
+		recordAuthEvent(r, authEventCodeVerified, u.Username, email, "email-change")
+		recordAuthEvent(r, authEventEmailChanged, u.Username, email, maskEmail(u.Email))
+
+		w.Header().Add("HX-Redirect", "/account/")
+		w.WriteHeader(http.StatusSeeOther)
+	})))
+
+	http.HandleFunc("POST /account/delete/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		// Sessions, tokens, passkeys and identities go through ON DELETE
+		// CASCADE.
+		if _, err := db.Exec("DELETE FROM users WHERE username = ?", u.Username); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if u.Email != "" {
+			if _, err := db.Exec("DELETE FROM user_log_in_email_tokens WHERE email = ?", u.Email); err != nil {
+				slog.ErrorContext(r.Context(), "delete log in tokens failed", "err", err)
+			}
+		}
+		endSession(w, r)
+		// auth_events.username is now NULL, so the username goes in detail.
+		recordAuthEvent(r, authEventAccountDeleted, "", u.Email, u.Username)
+
+		w.Header().Add("HX-Redirect", "/")
+		w.WriteHeader(http.StatusSeeOther)
+	}))
+
+	http.HandleFunc("POST /account/sessions/{id}/revoke/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+
+		if revoked, err := revokeSession(r.Context(), u.Username, id); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		} else if !revoked {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+		recordAuthEvent(r, authEventSessionRevoked, u.Username, "", strconv.FormatInt(id, 10))
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	http.HandleFunc("POST /account/sessions/revoke-all/{$}", RequireUser(func(w http.ResponseWriter, r *http.Request, u *User) {
+		if err := revokeAllSessions(r.Context(), u.Username); err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		endSession(w, r)
+		recordAuthEvent(r, authEventAllSessionsRevoked, u.Username, "", "")
+
+		w.Header().Add("HX-Redirect", "/")
+		w.WriteHeader(http.StatusSeeOther)
+	}))
+
+	if sesTopicARN != "" {
+		http.HandleFunc("POST /ses-notifications/{$}", func(w http.ResponseWriter, r *http.Request) {
+			msg := SNSMessage{}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 256<<10)).Decode(&msg); err != nil {
+				writeError(w, r, http.StatusBadRequest)
+				return
+			}
+
+			if msg.TopicArn != sesTopicARN {
+				writeError(w, r, http.StatusForbidden)
+				return
+			}
+			if err := verifySNSMessage(r.Context(), &msg); err != nil {
+				slog.WarnContext(r.Context(), "request rejected", "err", err)
+				writeError(w, r, http.StatusForbidden)
+				return
+			}
+
+			switch msg.Type {
+			case "SubscriptionConfirmation":
+				if err := confirmSNSSubscription(r.Context(), &msg); err != nil {
+					slog.WarnContext(r.Context(), "request rejected", "err", err)
+					writeError(w, r, http.StatusBadGateway)
+					return
+				}
+			case "Notification":
+				if err := recordSESNotification(r.Context(), msg.Message); err != nil {
+					slog.ErrorContext(r.Context(), "request failed", "err", err)
+					writeError(w, r, http.StatusInternalServerError)
+					return
+				}
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	http.HandleFunc("GET /admin/emails/{$}", RequireRole("admin", func(w http.ResponseWriter, r *http.Request, u *User) {
+		emails, err := listOutboxEmails(r.Context(), 100)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		executePage(w, r, "admin-emails.tmpl", emails)
+	}))
+
+	http.HandleFunc("GET /admin/auth-events/{$}", RequireRole("admin", func(w http.ResponseWriter, r *http.Request, u *User) {
+		query := r.URL.Query()
+		filter := AuthEventFilter{
+			Username: query.Get("username"),
+			Email:    strings.ToLower(strings.TrimSpace(query.Get("email"))),
+			Event:    query.Get("event"),
+			IP:       query.Get("ip"),
+			Limit:    100,
+		}
+		if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+			filter.Limit = min(limit, 1000)
+		}
+
+		events, err := listAuthEvents(r.Context(), filter)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		executePage(w, r, "admin-auth-events.tmpl", map[string]any{
+			"filter": filter,
+			"events": events,
+			"kinds":  authEvents,
+		})
+	}))
+
+	http.HandleFunc("GET /dev/emails/{$}", RequireRole("admin", func(w http.ResponseWriter, r *http.Request, u *User) {
+		previews, err := previewEmails()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "request failed", "err", err)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		executePage(w, r, "dev-emails.tmpl", previews)
+	}))
+
+	http.HandleFunc("GET /static/{name...}", serveStaticAsset)
+
+	// METRICS_TOKEN serves /metrics to requests bearing it; METRICS_ADDR
+	// serves it without one on a separate address, such as a private port.
+	if v, ok := os.LookupEnv("METRICS_TOKEN"); ok {
+		http.Handle("GET /metrics", metricsHandler(v))
+	}
+	if v, ok := os.LookupEnv("METRICS_ADDR"); ok {
+		go func() {
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle("GET /metrics", promhttp.Handler())
+			if err := http.ListenAndServe(v, metricsMux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if err := http.ListenAndServe(":"+port, withRequestID(accessLog(securityHeaders(withUser(csrfProtect(withErrorPages(http.DefaultServeMux))))))); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// PageData is what page.tmpl renders; the handler's data is under .Data.
+type PageData struct {
+	Data      any
+	CSRFToken string
+	// Locale is the one the page is rendered in, see siteLocale.
+	Locale string
+	// CSPNonce goes on every inline script.
+	CSPNonce string
+}
+
+// executePage renders the page template name, or the 500 page if that
+// fails. Nothing is written until rendering succeeded.
+func executePage(w http.ResponseWriter, r *http.Request, name string, data any) {
+	if err := renderPage(w, r, http.StatusOK, name, data); err != nil {
+		slog.ErrorContext(r.Context(), "request failed", "err", err)
+		writeError(w, r, http.StatusInternalServerError)
+	}
+}
+
+func renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data any) error {
+	locale := siteLocale(r)
+
+	templatesMu.RLock()
+	page, ok := pageTmpl[locale][name]
+	templatesMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown page template %s", name)
+	}
+
+	pageData := PageData{
+		Data:      data,
+		CSRFToken: csrfToken(w, r),
+		Locale:    locale,
+		CSPNonce:  cspNonce(r),
 	}
 
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	minifyWriter := minifier.Writer("text/html", buf)
+	if err := page.ExecuteTemplate(minifyWriter, "page", pageData); err != nil {
+		return err
+	}
+	if err := minifyWriter.Close(); err != nil {
+		return err
+	}
+
+	writeHTML(w, r, status, buf.Bytes(), pageData.CSPNonce)
+	return nil
+}
+
+// executeTemplates renders the fragments names for htmx, one after another,
+// in r's locale. writeError renders through it, so its own failures fall
+// back to plain text.
+func executeTemplates(w http.ResponseWriter, r *http.Request, data any, trigger string, names ...string) {
+	executeTemplatesStatus(w, r, http.StatusOK, data, trigger, names...)
+}
+
+// executeTemplatesStatus is executeTemplates responding with status. The
+// status is only written once rendering succeeded, so a failure can still
+// respond with a 500.
+func executeTemplatesStatus(w http.ResponseWriter, r *http.Request, status int, data any, trigger string, names ...string) {
+	locale := siteLocale(r)
+
+	templatesMu.RLock()
+	t := tmpl[locale]
+	templatesMu.RUnlock()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	minifyWriter := minifier.Writer("text/html", buf)
 	for _, name := range names {
-		if err := tmpl.ExecuteTemplate(minifyWriter, name, data); err != nil {
-			log.Println(err)
+		if err := t.ExecuteTemplate(minifyWriter, name, data); err != nil {
+			slog.ErrorContext(r.Context(), "render fragment failed", "err", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 	}
+	if err := minifyWriter.Close(); err != nil {
+		slog.ErrorContext(r.Context(), "render fragment failed", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if len(trigger) > 0 {
+		w.Header().Add("HX-Trigger", trigger)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
 }
 
 type User struct {
 	Email    string
 	Username string
+	// Locale is empty when the user hasn't picked one.
+	Locale string
+	Roles  []string
 }
 
-func getSessionUser(r *http.Request) (*User, bool, error) {
-	cookie, err := r.Cookie("session")
+// createUser creates a user without an email address for a third-party
+// identity. The username is derived from base, and insertIdentity writes the
+// identity row in the same transaction.
+func createUser(ctx context.Context, base string, insertIdentity func(tx *sql.Tx, username string) error) (string, error) {
+	username, err := uniqueUsername(ctx, base)
 	if err != nil {
-		return nil, false, nil
+		return "", err
 	}
 
-	rows, err := sessionStmt.Query(cookie.Value)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, false, err
+		return "", err
 	}
+	defer tx.Rollback()
 
-	u := User{}
-	if !rows.Next() {
-		return nil, false, nil
+	if _, err := tx.Exec("INSERT INTO users (username) VALUES (?)", username); err != nil {
+		return "", err
 	}
-
-	if err := rows.Scan(&u.Username, &u.Email); err != nil {
-		return nil, false, err
+	if err := insertIdentity(tx, username); err != nil {
+		return "", err
 	}
 
-	return &u, true, nil
+	return username, tx.Commit()
 }
 
 type BskyUserProfile struct {
@@ -957,15 +2044,3 @@ type BskyUserProfile struct {
 	Avatar      string `json:"avatar"`
 	DisplayName string `json:"displayName"`
 }
-
-func rateLimit(limit float64, burst int, next http.HandlerFunc) http.HandlerFunc {
-	limiter := rate.NewLimiter(rate.Limit(limit), burst)
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
-			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-			return
-		}
-
-		next(w, r)
-	}
-}
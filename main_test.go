@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/html"
+)
+
+// openTestDB points db at a fresh database migrated to the latest version,
+// for as long as t runs.
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	openEmptyTestDB(t)
+	if err := migrateLatest(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	previousStmt := sessionStmt
+	if err := prepareSessionStmt(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sessionStmt.Close()
+		sessionStmt = previousStmt
+	})
+}
+
+// openEmptyTestDB points db at a fresh database with no tables at all, for
+// as long as t runs.
+func openEmptyTestDB(t *testing.T) {
+	t.Helper()
+
+	previous := db
+	testDB, err := sql.Open("sqlite-instrumented", "file:"+filepath.Join(t.TempDir(), "db")+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = testDB
+	t.Cleanup(func() {
+		testDB.Close()
+		db = previous
+	})
+}
+
+// loadTestTemplates loads the templates and the HTML minifier pages are
+// rendered with.
+func loadTestTemplates(t *testing.T) {
+	t.Helper()
+
+	minifier = minify.New()
+	minifier.AddFunc("text/html", html.Minify)
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"modernc.org/sqlite"
+)
+
+var (
+	jetstreamEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jetstream_events_total",
+		Help: "Jetstream events read, by collection.",
+	}, []string{"collection"})
+	jetstreamLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jetstream_cursor_lag_seconds",
+		Help: "How far behind now the last Jetstream event read was.",
+	})
+	jetstreamReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jetstream_reconnects_total",
+		Help: "Times the Jetstream connection was lost and made again.",
+	})
+
+	feedSkeletonDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "feed_skeleton_duration_seconds",
+		Help:    "Time taken to serve getFeedSkeleton, by limit.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"limit"})
+
+	sqliteQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sqlite_query_duration_seconds",
+		Help:    "Time taken by SQLite statements, by whether they are exec or query.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"op"})
+
+	outboxEmails = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbox_emails_total",
+		Help: "Emails the outbox tried to send, by result: sent, retry, bounced, failed or suppressed.",
+	}, []string{"result"})
+
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_rejections_total",
+		Help: "Requests rejected by a rate limit, by policy.",
+	}, []string{"policy"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bsky_feed_members",
+		Help: "Members of the Taiwanese feed.",
+	}, countRows("bsky_feed_taiwanese_users"))
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bsky_feed_posts",
+		Help: "Posts in the Taiwanese feed.",
+	}, countRows("bsky_feed_taiwanese_posts"))
+
+	sql.Register("sqlite-instrumented", instrumentedDriver{&sqlite.Driver{}})
+}
+
+// countRows returns a func counting the rows of table when scraped.
+func countRows(table string) func() float64 {
+	return func() float64 {
+		var n int64
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			slog.Warn("count rows failed", "table", table, "err", err)
+			return math.NaN()
+		}
+		return float64(n)
+	}
+}
+
+// metricsHandler serves the metrics to requests bearing token.
+func metricsHandler(token string) http.Handler {
+	next := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instrumentedDriver is the sqlite driver with every statement timed into
+// sqliteQueryDuration.
+type instrumentedDriver struct {
+	*sqlite.Driver
+}
+
+// sqliteConn is what modernc.org/sqlite connections implement; database/sql
+// only uses what the wrapper implements too.
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+type sqliteStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(sqliteConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("sqlite connection is a %T", c)
+	}
+	return instrumentedConn{conn}, nil
+}
+
+func observeQuery(op string, start time.Time) {
+	sqliteQueryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+type instrumentedConn struct {
+	sqliteConn
+}
+
+func (c instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	s, err := c.sqliteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	stmt, ok := s.(sqliteStmt)
+	if !ok {
+		s.Close()
+		return nil, fmt.Errorf("sqlite statement is a %T", s)
+	}
+	return instrumentedStmt{stmt}, nil
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer observeQuery("exec", time.Now())
+	return c.sqliteConn.ExecContext(ctx, query, args)
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer observeQuery("query", time.Now())
+	return c.sqliteConn.QueryContext(ctx, query, args)
+}
+
+type instrumentedStmt struct {
+	sqliteStmt
+}
+
+func (s instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer observeQuery("exec", time.Now())
+	return s.sqliteStmt.ExecContext(ctx, args)
+}
+
+func (s instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer observeQuery("query", time.Now())
+	return s.sqliteStmt.QueryContext(ctx, args)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Migrations are numbered from 0001, applied in order and never edited once
+// released; a change to the schema is a new file.
+//
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+var migrationNamePattern = regexp.MustCompile(`^(\d{4})_([a-z0-9_]+)\.sql$`)
+
+type Migration struct {
+	Version   int
+	Name      string
+	SQL       string
+	Checksum  string
+	AppliedAt string
+}
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []Migration{}
+	for _, entry := range entries {
+		match := migrationNamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s isn't named like 0001_name.sql", entry.Name())
+		}
+		data, err := fs.ReadFile(migrationFS, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		if version != len(migrations)+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence, expected version %d", entry.Name(), len(migrations)+1)
+		}
+		sum := sha256.Sum256(data)
+		migrations = append(migrations, Migration{
+			Version:  version,
+			Name:     match[2],
+			SQL:      string(data),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	return migrations, nil
+}
+
+// baselineTables are the tables of the released init.sql, which
+// 0001_baseline.sql recreates.
+var baselineTables = []string{
+	"users",
+	"user_sign_up_email_tokens",
+	"user_log_in_email_tokens",
+	"user_log_in_sessions",
+	"bsky_feed_taiwanese_users",
+	"bsky_feed_taiwanese_block_users",
+	"bsky_feed_taiwanese_posts",
+}
+
+// ensureSchemaMigrations creates schema_migrations. A database made by hand
+// from the released init.sql, before there were migrations, is marked as
+// already at the baseline. Anything else without schema_migrations isn't a
+// schema we know how to migrate.
+func ensureSchemaMigrations(ctx context.Context, migrations []Migration) error {
+	tables := map[string]bool{}
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		tables[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if tables["schema_migrations"] {
+		return nil
+	}
+
+	adopted := 0
+	if len(tables) > 0 {
+		for name := range tables {
+			if !slices.Contains(baselineTables, name) && !strings.HasPrefix(name, "sqlite_") {
+				return fmt.Errorf("database has table %s but no schema_migrations, so it isn't the released init.sql schema", name)
+			}
+		}
+		for _, name := range baselineTables {
+			if !tables[name] {
+				return fmt.Errorf("database has no table %s, so it isn't the released init.sql schema", name)
+			}
+		}
+		adopted = 1
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TABLE schema_migrations(
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TEXT DEFAULT CURRENT_TIMESTAMP
+		)
+	`); err != nil {
+		return err
+	}
+
+	for _, m := range migrations[:min(adopted, len(migrations))] {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO schema_migrations (version, name, checksum)
+			VALUES (?, ?, ?)
+		`, m.Version, m.Name, m.Checksum); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrationStatus returns every migration with AppliedAt set on those
+// applied. Applied migrations whose file changed since, or which this build
+// doesn't know about, are an error.
+func migrationStatus(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSchemaMigrations(ctx, migrations); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var checksum, appliedAt string
+		if err := rows.Scan(&version, &checksum, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		if version < 1 || version > len(migrations) {
+			return nil, fmt.Errorf("database has migration %04d, which this build doesn't know about", version)
+		}
+		m := &migrations[version-1]
+		if m.Checksum != checksum {
+			return nil, fmt.Errorf("migration %04d_%s changed after it was applied", m.Version, m.Name)
+		}
+		m.AppliedAt = appliedAt
+	}
+
+	return migrations, rows.Err()
+}
+
+// migrate applies the pending migrations up to and including target.
+// There are no down migrations, so target can't be below the applied ones.
+func migrate(ctx context.Context, target int) error {
+	migrations, err := migrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("no migration %04d", target)
+	}
+	for _, m := range migrations[target:] {
+		if m.AppliedAt != "" {
+			return fmt.Errorf("can't migrate down to %04d, %04d_%s is applied", target, m.Version, m.Name)
+		}
+	}
+
+	for _, m := range migrations[:target] {
+		if m.AppliedAt != "" {
+			continue
+		}
+		if err := applyMigration(ctx, m); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateLatest applies every pending migration.
+func migrateLatest(ctx context.Context) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, len(migrations))
+}
+
+// migrationChecks run before the migration of their version, to refuse data
+// it can't carry over with a clearer error than the one SQLite would give.
+var migrationChecks = map[int]func(ctx context.Context, tx *sql.Tx) error{
+	2: checkCaseDuplicateEmails,
+}
+
+// checkCaseDuplicateEmails names the users whose emails only differ by case,
+// which 0002_accounts.sql lowercases into a UNIQUE column.
+func checkCaseDuplicateEmails(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT lower(email), group_concat(username, ', ')
+		FROM users
+		GROUP BY lower(email)
+		HAVING COUNT(*) > 1
+		ORDER BY lower(email)
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var conflicts []string
+	for rows.Next() {
+		var email, usernames string
+		if err := rows.Scan(&email, &usernames); err != nil {
+			return err
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s)", email, usernames))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("emails are shared by users once lowercased, change all but one user's email first: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// applyMigration runs m in a transaction, after its check in
+// migrationChecks if any. Foreign keys are off meanwhile so tables can be
+// rebuilt, and checked before committing.
+func applyMigration(ctx context.Context, m Migration) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if check, ok := migrationChecks[m.Version]; ok {
+		if err := check(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+
+	var table string
+	if err := tx.QueryRowContext(ctx, "PRAGMA foreign_key_check").Scan(&table, new(any), new(any), new(any)); err == nil {
+		return fmt.Errorf("foreign key check failed on %s", table)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO schema_migrations (version, name, checksum)
+		VALUES (?, ?, ?)
+	`, m.Version, m.Name, m.Checksum); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runMigrateCommand implements the migrate subcommand:
+//
+//	migrate          apply every pending migration
+//	migrate VERSION  apply pending migrations up to VERSION
+//	migrate status   list migrations and whether they're applied
+func runMigrateCommand(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: migrate [status | VERSION]")
+	}
+
+	if len(args) == 1 && args[0] == "status" {
+		migrations, err := migrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, m := range migrations {
+			status := "pending"
+			if m.AppliedAt != "" {
+				status = "applied " + m.AppliedAt
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", m.Version, m.Name, status)
+		}
+		return w.Flush()
+	}
+
+	if len(args) == 0 {
+		return migrateLatest(ctx)
+	}
+
+	target, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New("usage: migrate [status | VERSION]")
+	}
+	return migrate(ctx, target)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := len(migrations)
+
+	exec := func(t *testing.T, query string, args ...any) {
+		t.Helper()
+		if _, err := db.ExecContext(t.Context(), query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		// setup makes the database the migrations find.
+		setup func(t *testing.T)
+		// target is the version to migrate to, or the latest if zero.
+		target  int
+		want    int
+		wantErr bool
+		// wantErrText is in the error, if set.
+		wantErrText string
+	}{
+		{
+			name:  "empty database",
+			setup: func(t *testing.T) {},
+			want:  latest,
+		},
+		{
+			name:   "empty database to a version",
+			setup:  func(t *testing.T) {},
+			target: 1,
+			want:   1,
+		},
+		{
+			name: "released init.sql is adopted",
+			setup: func(t *testing.T) {
+				exec(t, migrations[0].SQL)
+				exec(t, "INSERT INTO users (username, email) VALUES ('alice', 'alice@example.com')")
+			},
+			want: latest,
+		},
+		{
+			name: "emails differing only by case",
+			setup: func(t *testing.T) {
+				exec(t, migrations[0].SQL)
+				exec(t, `INSERT INTO users (username, email) VALUES
+					('alice', 'alice@example.com'),
+					('Alice2', 'Alice@Example.com'),
+					('bob', 'bob@example.com')`)
+			},
+			wantErr:     true,
+			wantErrText: "alice@example.com (alice, Alice2)",
+		},
+		{
+			name: "unknown table",
+			setup: func(t *testing.T) {
+				exec(t, migrations[0].SQL)
+				exec(t, "CREATE TABLE accounts(id INTEGER PRIMARY KEY)")
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing table",
+			setup: func(t *testing.T) {
+				exec(t, migrations[0].SQL)
+				exec(t, "DROP TABLE user_log_in_email_tokens")
+			},
+			wantErr: true,
+		},
+		{
+			name: "applied migration changed",
+			setup: func(t *testing.T) {
+				if err := migrate(t.Context(), 1); err != nil {
+					t.Fatal(err)
+				}
+				exec(t, "UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1")
+			},
+			wantErr: true,
+		},
+		{
+			name: "migration from a newer build",
+			setup: func(t *testing.T) {
+				if err := migrate(t.Context(), 1); err != nil {
+					t.Fatal(err)
+				}
+				exec(t, "INSERT INTO schema_migrations (version, name, checksum) VALUES (?, 'future', '')", latest+1)
+			},
+			wantErr: true,
+		},
+		{
+			name: "down",
+			setup: func(t *testing.T) {
+				if err := migrateLatest(t.Context()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			target:  1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openEmptyTestDB(t)
+			tt.setup(t)
+
+			target := tt.target
+			if target == 0 {
+				target = latest
+			}
+			err := migrate(t.Context(), target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), tt.wantErrText) {
+					t.Errorf("err = %v, want it to mention %q", err, tt.wantErrText)
+				}
+				return
+			}
+
+			if got := appliedVersion(t); got != tt.want {
+				t.Errorf("applied up to %d, want %d", got, tt.want)
+			}
+			if err := db.QueryRowContext(t.Context(), "PRAGMA foreign_key_check").Scan(new(any), new(any), new(any), new(any)); err == nil {
+				t.Error("foreign key check failed")
+			}
+		})
+	}
+}
+
+// appliedVersion returns the last migration applied, checking that every
+// one before it is applied too.
+func appliedVersion(t *testing.T) int {
+	t.Helper()
+
+	migrations, err := migrationStatus(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := 0
+	for _, m := range migrations {
+		if m.AppliedAt == "" {
+			break
+		}
+		version = m.Version
+	}
+	for _, m := range migrations[version:] {
+		if m.AppliedAt != "" {
+			t.Errorf("%04d_%s is applied after a pending migration", m.Version, m.Name)
+		}
+	}
+	return version
+}
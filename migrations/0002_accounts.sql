@@ -0,0 +1,157 @@
+-- Accounts: optional email, passkeys, Bluesky and Threads identities, roles,
+-- hashed email codes and sessions, the email outbox and the audit log.
+
+-- This logs everyone out. Sessions and email codes were stored in plain
+-- text and can't be carried over as hashes, so every session and pending
+-- sign-up or log in code is dropped and users have to log in again.
+DROP TABLE user_sign_up_email_tokens;
+DROP TABLE user_log_in_email_tokens;
+DROP TABLE user_log_in_sessions;
+
+CREATE TABLE users_new(
+	username VARCHAR(32) NOT NULL PRIMARY KEY,
+	email TEXT UNIQUE,
+	webauthn_id BLOB UNIQUE,
+	locale TEXT
+);
+
+-- Emails are compared lowercased from now on. Users whose emails only
+-- differ by case are refused beforehand, see checkCaseDuplicateEmails.
+INSERT INTO users_new (username, email)
+SELECT username, lower(email) FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE TABLE user_roles(
+	username VARCHAR(32) NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	role TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (username, role)
+);
+
+CREATE TABLE user_sign_up_email_tokens(
+	username VARCHAR(32) NOT NULL PRIMARY KEY,
+	email TEXT NOT NULL UNIQUE,
+	token_hash TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	expires_at TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE user_log_in_email_tokens(
+	email TEXT NOT NULL PRIMARY KEY,
+	token_hash TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	expires_at TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE user_email_change_tokens(
+	email TEXT NOT NULL PRIMARY KEY,
+	username VARCHAR(32) NOT NULL UNIQUE REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	token_hash TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	expires_at TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE email_code_lockouts(
+	email TEXT NOT NULL PRIMARY KEY,
+	locked_until TEXT NOT NULL
+);
+
+CREATE TABLE user_log_in_sessions(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token_hash TEXT NOT NULL UNIQUE,
+	username VARCHAR(32) NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+	last_seen_at TEXT DEFAULT CURRENT_TIMESTAMP,
+	expires_at TEXT NOT NULL,
+	max_expires_at TEXT NOT NULL
+);
+
+CREATE INDEX idx_user_log_in_sessions_username ON user_log_in_sessions(username);
+
+CREATE TABLE user_passkeys(
+	id BLOB NOT NULL PRIMARY KEY,
+	username VARCHAR(32) NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	name TEXT NOT NULL,
+	credential TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TEXT
+);
+
+CREATE INDEX idx_user_passkeys_username ON user_passkeys(username);
+
+CREATE TABLE passkey_ceremonies(
+	id TEXT NOT NULL PRIMARY KEY,
+	username VARCHAR(32) REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	data TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE user_bsky_identities(
+	did TEXT NOT NULL PRIMARY KEY,
+	username VARCHAR(32) NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	handle TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE user_threads_identities(
+	threads_user_id TEXT NOT NULL PRIMARY KEY,
+	username VARCHAR(32) NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	access_token BLOB NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE bsky_oauth_requests(
+	state TEXT NOT NULL PRIMARY KEY,
+	link_username VARCHAR(32) REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+	did TEXT,
+	issuer TEXT NOT NULL,
+	token_endpoint TEXT NOT NULL,
+	pkce_verifier TEXT NOT NULL,
+	dpop_key TEXT NOT NULL,
+	dpop_nonce TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE email_outbox(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	sender TEXT NOT NULL,
+	recipient TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	html TEXT NOT NULL,
+	text TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TEXT NOT NULL,
+	last_error TEXT,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+	sent_at TEXT
+);
+
+CREATE INDEX idx_email_outbox_status_next_attempt_at ON email_outbox(status, next_attempt_at);
+
+CREATE TABLE email_suppressions(
+	email TEXT NOT NULL PRIMARY KEY,
+	reason TEXT NOT NULL,
+	detail TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE auth_events(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(32) REFERENCES users ON DELETE SET NULL ON UPDATE CASCADE,
+	email TEXT,
+	event TEXT NOT NULL,
+	detail TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	created_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_auth_events_username ON auth_events(username);
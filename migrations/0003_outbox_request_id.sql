@@ -0,0 +1,4 @@
+-- The ID of the request that queued each message, so sending it is logged
+-- under the same ID.
+
+ALTER TABLE email_outbox ADD COLUMN request_id TEXT;
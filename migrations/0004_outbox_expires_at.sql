@@ -0,0 +1,4 @@
+-- When each message stops being worth sending. Verification codes expire
+-- after emailCodeTTL, so their mail is dropped rather than delivered late.
+
+ALTER TABLE email_outbox ADD COLUMN expires_at TEXT;
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/textproto"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+const (
+	outboxMaxAttempts  = 8
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = time.Hour
+	outboxPollInterval = 5 * time.Second
+	outboxSendTimeout  = 30 * time.Second
+)
+
+var outboxWake = make(chan struct{}, 1)
+
+type OutboxEmail struct {
+	ID        int64
+	Recipient string
+	Subject   string
+	Status    string
+	Attempts  int
+	LastError string
+	CreatedAt string
+	SentAt    string
+}
+
+// enqueueEmail stores msg in email_outbox within tx. The message is only
+// sent once tx commits, and survives restarts until it is or until
+// expiresAt, if not zero. The request ID in ctx goes along, so sending it is
+// logged under that ID.
+func enqueueEmail(ctx context.Context, tx *sql.Tx, msg *EmailMessage, expiresAt time.Time) error {
+	var expires sql.NullString
+	if !expiresAt.IsZero() {
+		expires = nullString(expiresAt.UTC().Format(time.DateTime))
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO email_outbox (sender, recipient, subject, html, text, next_attempt_at, expires_at, request_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, msg.From, msg.To, msg.Subject, msg.HTML, msg.Text, time.Now().UTC().Format(time.DateTime), expires, nullString(requestIDFromContext(ctx)))
+	return err
+}
+
+// wakeOutbox nudges the outbox worker after a commit that queued messages,
+// so it doesn't wait for the next poll.
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// runOutbox sends queued messages until ctx is done, retrying transient
+// failures with exponential backoff.
+func runOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := expireOutboxEmails(ctx); err != nil {
+			slog.ErrorContext(ctx, "expire outbox failed", "err", err)
+		}
+		for {
+			sent, err := sendNextOutboxEmail(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "outbox failed", "err", err)
+				break
+			} else if !sent {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-outboxWake:
+		}
+	}
+}
+
+// expireOutboxEmails fails the pending messages past their expires_at,
+// clearing the codes in their bodies, however long until their next attempt.
+func expireOutboxEmails(ctx context.Context) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE email_outbox
+		SET status = 'failed', last_error = 'expired before it was sent', html = '', text = ''
+		WHERE status = 'pending' AND expires_at <= ?
+	`, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		outboxEmails.WithLabelValues("failed").Add(float64(n))
+		slog.WarnContext(ctx, "emails expired before they were sent", "count", n)
+	}
+	return nil
+}
+
+// sendNextOutboxEmail attempts the oldest due message and reports whether
+// there was one.
+func sendNextOutboxEmail(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+
+	var id int64
+	var attempts int
+	var requestID sql.NullString
+	msg := EmailMessage{}
+	if err := db.QueryRowContext(ctx, `
+		SELECT id, sender, recipient, subject, html, text, attempts, request_id
+		FROM email_outbox
+		WHERE status = 'pending' AND next_attempt_at <= ?1
+		AND (expires_at IS NULL OR expires_at > ?1)
+		ORDER BY next_attempt_at, id
+		LIMIT 1
+	`, now.Format(time.DateTime)).Scan(&id, &msg.From, &msg.To, &msg.Subject, &msg.HTML, &msg.Text, &attempts, &requestID); errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if requestID.Valid {
+		ctx = contextWithRequestID(ctx, requestID.String)
+	}
+
+	// The address may have bounced since the message was queued.
+	if err := checkEmailSuppressed(ctx, msg.To); errors.Is(err, errEmailSuppressed) {
+		outboxEmails.WithLabelValues("suppressed").Inc()
+		_, err := db.ExecContext(ctx, `
+			UPDATE email_outbox
+			SET status = 'suppressed', html = '', text = ''
+			WHERE id = ?
+		`, id)
+		return true, err
+	} else if err != nil {
+		return false, err
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+	sendErr := mailer.Send(sendCtx, &msg)
+	cancel()
+
+	attempts++
+	if sendErr == nil {
+		outboxEmails.WithLabelValues("sent").Inc()
+		// Bodies hold verification codes, so they aren't kept once sent.
+		_, err := db.ExecContext(ctx, `
+			UPDATE email_outbox
+			SET status = 'sent', attempts = ?, sent_at = ?, html = '', text = '', last_error = NULL
+			WHERE id = ?
+		`, attempts, now.Format(time.DateTime), id)
+		return true, err
+	}
+
+	slog.WarnContext(ctx, "send email failed", "id", id, "attempts", attempts, "err", sendErr)
+
+	status := "pending"
+	if isPermanentMailError(sendErr) {
+		status = "bounced"
+	} else if attempts >= outboxMaxAttempts {
+		status = "failed"
+	}
+	if status == "pending" {
+		outboxEmails.WithLabelValues("retry").Inc()
+	} else {
+		outboxEmails.WithLabelValues(status).Inc()
+	}
+
+	backoff := min(outboxBaseBackoff<<(attempts-1), outboxMaxBackoff)
+	backoff += rand.N(backoff / 4)
+
+	if status == "pending" {
+		_, err := db.ExecContext(ctx, `
+			UPDATE email_outbox
+			SET attempts = ?, next_attempt_at = ?, last_error = ?
+			WHERE id = ?
+		`, attempts, now.Add(backoff).Format(time.DateTime), sendErr.Error(), id)
+		return true, err
+	}
+
+	_, err := db.ExecContext(ctx, `
+		UPDATE email_outbox
+		SET status = ?, attempts = ?, last_error = ?, html = '', text = ''
+		WHERE id = ?
+	`, status, attempts, sendErr.Error(), id)
+	return true, err
+}
+
+// isPermanentMailError reports whether retrying err is pointless, such as
+// SES rejecting the message or an SMTP 5xx reply.
+func isPermanentMailError(err error) bool {
+	var rejected *types.MessageRejected
+	if errors.As(err, &rejected) {
+		return true
+	}
+
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+		return true
+	}
+
+	return false
+}
+
+// listOutboxEmails lists the latest messages for admins, leaving out the
+// bodies, which hold codes until sent.
+func listOutboxEmails(ctx context.Context, limit int) ([]OutboxEmail, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, recipient, subject, status, attempts, COALESCE(last_error, ''), created_at, COALESCE(sent_at, '')
+		FROM email_outbox
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []OutboxEmail{}
+	for rows.Next() {
+		e := OutboxEmail{}
+		if err := rows.Scan(&e.ID, &e.Recipient, &e.Subject, &e.Status, &e.Attempts, &e.LastError, &e.CreatedAt, &e.SentAt); err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+
+	return emails, rows.Err()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingMailer collects what it's asked to send, failing with err.
+type recordingMailer struct {
+	sent []*EmailMessage
+	err  error
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg *EmailMessage) error {
+	m.sent = append(m.sent, msg)
+	return m.err
+}
+
+func TestSendNextOutboxEmail(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		sendErr   error
+		// wantSent is whether the mailer is asked to send the message.
+		wantSent   bool
+		wantStatus string
+		wantBody   bool
+	}{
+		{
+			name:       "sent",
+			expiresAt:  time.Now().Add(emailCodeTTL),
+			wantSent:   true,
+			wantStatus: "sent",
+		},
+		{
+			name:       "no expiry",
+			wantSent:   true,
+			wantStatus: "sent",
+		},
+		{
+			name:       "retried",
+			expiresAt:  time.Now().Add(emailCodeTTL),
+			sendErr:    errors.New("timeout"),
+			wantSent:   true,
+			wantStatus: "pending",
+			wantBody:   true,
+		},
+		{
+			name:       "expired code isn't sent",
+			expiresAt:  time.Now().Add(-time.Second),
+			wantStatus: "failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			previous := mailer
+			m := &recordingMailer{err: tt.sendErr}
+			mailer = m
+			t.Cleanup(func() { mailer = previous })
+
+			tx, err := db.BeginTx(t.Context(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &EmailMessage{From: mailFrom, To: "someone@example.com", Subject: "code", HTML: "<p>123456</p>", Text: "123456\n"}
+			if err := enqueueEmail(t.Context(), tx, msg, tt.expiresAt); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := expireOutboxEmails(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sendNextOutboxEmail(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+
+			if sent := len(m.sent) > 0; sent != tt.wantSent {
+				t.Errorf("sent = %v, want %v", sent, tt.wantSent)
+			}
+			var status, html, text string
+			if err := db.QueryRow("SELECT status, html, text FROM email_outbox").Scan(&status, &html, &text); err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", status, tt.wantStatus)
+			}
+			if hasBody := html != "" || text != ""; hasBody != tt.wantBody {
+				t.Errorf("body kept = %v, want %v", hasBody, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var webAuthn *webauthn.WebAuthn
+
+func newWebAuthn(publicURL string) (*webauthn.WebAuthn, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "台島",
+		RPOrigins:     []string{publicURL},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+}
+
+// PasskeyUser adapts a users row to webauthn.User. The WebAuthn user handle
+// is a random ID rather than the username, so renaming doesn't orphan
+// credentials.
+type PasskeyUser struct {
+	Username    string
+	ID          []byte
+	Credentials []webauthn.Credential
+}
+
+func (u *PasskeyUser) WebAuthnID() []byte                         { return u.ID }
+func (u *PasskeyUser) WebAuthnName() string                       { return u.Username }
+func (u *PasskeyUser) WebAuthnDisplayName() string                { return u.Username }
+func (u *PasskeyUser) WebAuthnCredentials() []webauthn.Credential { return u.Credentials }
+
+type Passkey struct {
+	ID         string
+	Name       string
+	CreatedAt  string
+	LastUsedAt string
+}
+
+// getPasskeyUser loads username's credentials, assigning a WebAuthn user
+// handle on first use.
+func getPasskeyUser(ctx context.Context, username string) (*PasskeyUser, error) {
+	u := PasskeyUser{Username: username}
+	if err := db.QueryRowContext(ctx, "SELECT webauthn_id FROM users WHERE username = ?", username).Scan(&u.ID); err != nil {
+		return nil, err
+	}
+
+	if len(u.ID) == 0 {
+		u.ID = make([]byte, 32)
+		if _, err := crand.Read(u.ID); err != nil {
+			return nil, err
+		}
+		if _, err := db.ExecContext(ctx, "UPDATE users SET webauthn_id = ? WHERE username = ?", u.ID, username); err != nil {
+			return nil, err
+		}
+	}
+
+	return &u, loadPasskeyCredentials(ctx, &u)
+}
+
+func getPasskeyUserByHandle(ctx context.Context, handle []byte) (*PasskeyUser, error) {
+	u := PasskeyUser{ID: handle}
+	if err := db.QueryRowContext(ctx, "SELECT username FROM users WHERE webauthn_id = ?", handle).Scan(&u.Username); err != nil {
+		return nil, err
+	}
+
+	return &u, loadPasskeyCredentials(ctx, &u)
+}
+
+func loadPasskeyCredentials(ctx context.Context, u *PasskeyUser) error {
+	rows, err := db.QueryContext(ctx, "SELECT credential FROM user_passkeys WHERE username = ?", u.Username)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return err
+		}
+
+		c := webauthn.Credential{}
+		if err := json.Unmarshal([]byte(raw), &c); err != nil {
+			return err
+		}
+		u.Credentials = append(u.Credentials, c)
+	}
+
+	return rows.Err()
+}
+
+func listPasskeys(ctx context.Context, username string) ([]Passkey, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, created_at, COALESCE(last_used_at, '')
+		FROM user_passkeys
+		WHERE username = ?
+		ORDER BY created_at
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var id []byte
+		p := Passkey{}
+		if err := rows.Scan(&id, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			return nil, err
+		}
+		p.ID = base64.RawURLEncoding.EncodeToString(id)
+		passkeys = append(passkeys, p)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// saveCeremony stores the server half of a registration or assertion
+// ceremony and binds it to the browser with a short-lived cookie.
+func saveCeremony(ctx context.Context, w http.ResponseWriter, username string, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	id := randomToken(24)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO passkey_ceremonies (id, username, data)
+		VALUES (?, ?, ?)
+	`, id, nullString(username), string(data)); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "passkey_ceremony",
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().Add(5 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// takeCeremony loads and deletes the ceremony bound to r, so each challenge
+// can only be answered once.
+func takeCeremony(ctx context.Context, r *http.Request, username string) (*webauthn.SessionData, error) {
+	cookie, err := r.Cookie("passkey_ceremony")
+	if err != nil {
+		return nil, err
+	}
+
+	var data string
+	if err := db.QueryRowContext(ctx, `
+		DELETE FROM passkey_ceremonies
+		WHERE id = ?
+		AND COALESCE(username, '') = ?
+		RETURNING data
+	`, cookie.Value, username).Scan(&data); err != nil {
+		return nil, err
+	}
+
+	session := webauthn.SessionData{}
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.Expires) {
+		return nil, errors.New("passkey ceremony expired")
+	}
+
+	return &session, nil
+}
+
+func savePasskey(ctx context.Context, username string, name string, c *webauthn.Credential) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO user_passkeys (id, username, name, credential)
+		VALUES (?, ?, ?, ?)
+	`, c.ID, username, name, string(data))
+	return err
+}
+
+func touchPasskey(ctx context.Context, c *webauthn.Credential) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE user_passkeys
+		SET credential = ?, last_used_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, string(data), c.ID)
+	return err
+}
+
+func deletePasskey(ctx context.Context, username string, encodedID string) (bool, error) {
+	id, err := base64.RawURLEncoding.DecodeString(encodedID)
+	if err != nil {
+		return false, nil
+	}
+
+	res, err := db.ExecContext(ctx, "DELETE FROM user_passkeys WHERE id = ? AND username = ?", id, username)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// passkeyLogIn finishes a discoverable assertion and returns the username
+// that owns the credential.
+func passkeyLogIn(r *http.Request, session *webauthn.SessionData) (string, error) {
+	ctx := r.Context()
+	user, credential, err := webAuthn.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		u, err := getPasskeyUserByHandle(ctx, userHandle)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("unknown passkey user")
+		}
+		return u, err
+	}, *session, r)
+	if err != nil {
+		return "", err
+	}
+
+	if credential.Authenticator.CloneWarning {
+		return "", errors.New("passkey sign count went backwards, possible cloned authenticator")
+	}
+
+	if err := touchPasskey(ctx, credential); err != nil {
+		return "", err
+	}
+
+	return user.(*PasskeyUser).Username, nil
+}
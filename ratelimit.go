@@ -0,0 +1,296 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitRule allows one request per Every with bursts of Burst, counted
+// separately for each value of Key: "ip", "email" or "session".
+type RateLimitRule struct {
+	Key   string
+	Every time.Duration
+	Burst int
+}
+
+// rateLimitPolicies are the rules applied to each rate limited route. They
+// can be overridden with RATE_LIMITS, see parseRateLimits.
+var rateLimitPolicies = map[string][]RateLimitRule{
+	"sign-up-by-email": {
+		{Key: "ip", Every: 6 * time.Second, Burst: 10},
+		{Key: "email", Every: time.Minute, Burst: 3},
+	},
+	"verify-sign-up-email": {
+		{Key: "ip", Every: time.Second, Burst: 10},
+		{Key: "email", Every: 10 * time.Second, Burst: 5},
+	},
+	"log-in-by-email": {
+		{Key: "ip", Every: 6 * time.Second, Burst: 10},
+		{Key: "email", Every: time.Minute, Burst: 3},
+	},
+	"verify-log-in-email": {
+		{Key: "ip", Every: time.Second, Burst: 10},
+		{Key: "email", Every: 10 * time.Second, Burst: 5},
+	},
+	"log-in-by-bsky": {
+		{Key: "ip", Every: time.Second, Burst: 10},
+	},
+	"log-in-by-passkey": {
+		{Key: "ip", Every: time.Second, Burst: 10},
+	},
+	"register-passkey": {
+		{Key: "session", Every: 6 * time.Second, Burst: 5},
+	},
+	"change-username": {
+		{Key: "session", Every: 6 * time.Second, Burst: 5},
+	},
+	"change-email": {
+		{Key: "session", Every: time.Minute, Burst: 3},
+		{Key: "email", Every: time.Minute, Burst: 3},
+	},
+	"verify-email-change": {
+		{Key: "session", Every: time.Second, Burst: 10},
+		{Key: "email", Every: 10 * time.Second, Burst: 5},
+	},
+}
+
+// rateLimitCapacity bounds how many keys each limiter remembers. The least
+// recently seen key is evicted first.
+const rateLimitCapacity = 10000
+
+var (
+	trustedProxies     []netip.Prefix
+	trustedProxyHeader = "X-Forwarded-For"
+)
+
+// parseRateLimits overrides rules from a spec like
+// "log-in-by-email.email=30s/5;log-in-by-email.ip=2s/10".
+func parseRateLimits(spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		target, value, ok := strings.Cut(entry, "=")
+		name, key, ok2 := strings.Cut(target, ".")
+		every, burst, ok3 := strings.Cut(value, "/")
+		if !ok || !ok2 || !ok3 {
+			return fmt.Errorf("invalid rate limit %q", entry)
+		}
+
+		d, err := time.ParseDuration(every)
+		if err != nil {
+			return fmt.Errorf("invalid rate limit %q: %w", entry, err)
+		}
+		b, err := strconv.Atoi(burst)
+		if err != nil {
+			return fmt.Errorf("invalid rate limit %q: %w", entry, err)
+		}
+		if key != "ip" && key != "email" && key != "session" {
+			return fmt.Errorf("invalid rate limit key %q", key)
+		}
+
+		rules := rateLimitPolicies[name]
+		replaced := false
+		for i := range rules {
+			if rules[i].Key == key {
+				rules[i] = RateLimitRule{Key: key, Every: d, Burst: b}
+				replaced = true
+			}
+		}
+		if !replaced {
+			rules = append(rules, RateLimitRule{Key: key, Every: d, Burst: b})
+		}
+		rateLimitPolicies[name] = rules
+	}
+
+	return nil
+}
+
+func parseTrustedProxies(spec string) error {
+	for _, cidr := range strings.Split(spec, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+
+	return nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client, honouring the proxy header
+// only when the request comes from a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(addr) {
+		return host
+	}
+
+	// Walk X-Forwarded-For style lists from the right, skipping our own
+	// proxies, so clients can't spoof the address by prepending entries.
+	hops := strings.Split(r.Header.Get(trustedProxyHeader), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !isTrustedProxy(hop) {
+			return hop.String()
+		}
+	}
+
+	return host
+}
+
+// rateLimitKey returns r's value for key. Emails are normalized like the
+// handlers do, so every spelling counts against the same account, and
+// sessions are hashed, so live session IDs aren't kept in the limiters.
+func rateLimitKey(r *http.Request, key string) string {
+	switch key {
+	case "ip":
+		return clientIP(r)
+	case "email":
+		email, _ := normalizeEmail(r.FormValue("email"))
+		return email
+	case "session":
+		if cookie, err := r.Cookie("session"); err == nil {
+			return hashSessionID(cookie.Value)
+		}
+	}
+	return ""
+}
+
+type keyedLimiter struct {
+	rule    RateLimitRule
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type keyedLimiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newKeyedLimiter(rule RateLimitRule) *keyedLimiter {
+	return &keyedLimiter{
+		rule:    rule,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// reserve takes a token for key at now, returning the reservation to cancel
+// it with, or how long the caller has to wait when none is available.
+func (l *keyedLimiter) reserve(key string, now time.Time) (*rate.Reservation, time.Duration, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var limiter *rate.Limiter
+	if el, ok := l.entries[key]; ok {
+		l.lru.MoveToFront(el)
+		limiter = el.Value.(*keyedLimiterEntry).limiter
+	} else {
+		limiter = rate.NewLimiter(rate.Every(l.rule.Every), l.rule.Burst)
+		l.entries[key] = l.lru.PushFront(&keyedLimiterEntry{key: key, limiter: limiter})
+
+		if l.lru.Len() > rateLimitCapacity {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*keyedLimiterEntry).key)
+		}
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return nil, l.rule.Every, false
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return nil, delay, false
+	}
+
+	return reservation, 0, true
+}
+
+// rateLimit applies the named policy in rateLimitPolicies to next. Each rule
+// is counted per client IP, email address or session; requests without a
+// value for a rule's key skip that rule.
+func rateLimit(name string, next http.HandlerFunc) http.HandlerFunc {
+	rules, ok := rateLimitPolicies[name]
+	if !ok {
+		panic("rateLimit: unknown policy " + name)
+	}
+
+	limiters := make([]*keyedLimiter, len(rules))
+	for i, rule := range rules {
+		limiters[i] = newKeyedLimiter(rule)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		var reservations []*rate.Reservation
+		var wait time.Duration
+		rejected := false
+		for _, limiter := range limiters {
+			key := rateLimitKey(r, limiter.rule.Key)
+			if key == "" {
+				continue
+			}
+
+			if reservation, delay, ok := limiter.reserve(key, now); ok {
+				reservations = append(reservations, reservation)
+			} else {
+				rejected = true
+				wait = max(wait, delay)
+			}
+		}
+
+		if rejected {
+			// A request rejected by one rule doesn't count against the
+			// others, or hitting the email limit would drain the IP one.
+			// Cancelling any later than now gives nothing back.
+			for _, reservation := range reservations {
+				reservation.CancelAt(now)
+			}
+
+			rateLimitRejections.WithLabelValues(name).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
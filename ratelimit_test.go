@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	l := newKeyedLimiter(RateLimitRule{Key: "ip", Every: time.Hour, Burst: 2})
+
+	for i, tt := range []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"a", true},
+		{"a", false},
+		{"b", true},
+		{"a", false},
+	} {
+		_, wait, ok := l.reserve(tt.key, time.Now())
+		if ok != tt.want {
+			t.Fatalf("request %d for %s allowed = %v, want %v", i, tt.key, ok, tt.want)
+		}
+		if !ok && (wait <= 0 || wait > time.Hour) {
+			t.Errorf("request %d wait = %v, want up to an hour", i, wait)
+		}
+	}
+}
+
+func TestKeyedLimiterEviction(t *testing.T) {
+	l := newKeyedLimiter(RateLimitRule{Key: "ip", Every: time.Hour, Burst: 1})
+
+	l.reserve("first", time.Now())
+	for i := range rateLimitCapacity {
+		l.reserve(strconv.Itoa(i), time.Now())
+	}
+
+	if len(l.entries) != rateLimitCapacity || l.lru.Len() != rateLimitCapacity {
+		t.Fatalf("remembers %d keys, want %d", len(l.entries), rateLimitCapacity)
+	}
+	// The least recently seen key was forgotten, so it starts afresh.
+	if _, _, ok := l.reserve("first", time.Now()); !ok {
+		t.Error("evicted key is still limited")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rateLimitPolicies["test"] = []RateLimitRule{
+		{Key: "ip", Every: time.Hour, Burst: 3},
+		{Key: "email", Every: time.Hour, Burst: 1},
+	}
+	t.Cleanup(func() { delete(rateLimitPolicies, "test") })
+
+	handler := rateLimit("test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for i, tt := range []struct {
+		email string
+		want  int
+	}{
+		{"a@example.com", http.StatusNoContent},
+		// Rejected by the email rule, which mustn't use up the IP's
+		// tokens.
+		{"a@example.com", http.StatusTooManyRequests},
+		{"a@example.com", http.StatusTooManyRequests},
+		{"b@example.com", http.StatusNoContent},
+		{"c@example.com", http.StatusNoContent},
+		{"d@example.com", http.StatusTooManyRequests},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/xrpc/test", strings.NewReader(url.Values{"email": {tt.email}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+
+		handler(w, r)
+
+		if w.Code != tt.want {
+			t.Fatalf("request %d for %s = %d, want %d", i, tt.email, w.Code, tt.want)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d has no Retry-After", i)
+		}
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		email   string
+		session string
+		want    string
+	}{
+		{name: "email", key: "email", email: "someone@example.com", want: "someone@example.com"},
+		{name: "email normalized", key: "email", email: " SomeOne@Example.COM ", want: "someone@example.com"},
+		{name: "no email", key: "email", want: ""},
+		{name: "session hashed", key: "session", session: "secret", want: hashSessionID("secret")},
+		{name: "no session", key: "session", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{"email": {tt.email}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.session != "" {
+				r.AddCookie(&http.Cookie{Name: "session", Value: tt.session})
+			}
+
+			if got := rateLimitKey(r, tt.key); got != tt.want {
+				t.Errorf("rateLimitKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	previous := trustedProxies
+	t.Cleanup(func() { trustedProxies = previous })
+	trustedProxies = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "198.51.100.7:1234", "", "198.51.100.7"},
+		{"untrusted peer's header is ignored", "198.51.100.7:1234", "203.0.113.9", "198.51.100.7"},
+		{"trusted proxy", "10.0.0.1:1234", "203.0.113.9", "203.0.113.9"},
+		{"spoofed entries on the left are skipped", "10.0.0.1:1234", "1.2.3.4, 203.0.113.9", "203.0.113.9"},
+		{"chained trusted proxies are skipped", "10.0.0.1:1234", "203.0.113.9, 10.0.0.2, 10.0.0.3", "203.0.113.9"},
+		{"only trusted hops", "10.0.0.1:1234", "10.0.0.2", "10.0.0.1"},
+		{"garbage stops the walk", "10.0.0.1:1234", "203.0.113.9, nonsense", "10.0.0.1"},
+		{"no header", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"IPv6 proxy", "[fd00::1]:1234", "2001:db8::5", "2001:db8::5"},
+		{"IPv4-mapped proxy", "[::ffff:10.0.0.1]:1234", "203.0.113.9", "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set(trustedProxyHeader, tt.forwarded)
+			}
+
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	previous := rateLimitPolicies["log-in-by-email"]
+	t.Cleanup(func() { rateLimitPolicies["log-in-by-email"] = previous })
+	rateLimitPolicies["log-in-by-email"] = append([]RateLimitRule(nil), previous...)
+
+	if err := parseRateLimits("log-in-by-email.email=30s/5; log-in-by-email.session=1s/2"); err != nil {
+		t.Fatal(err)
+	}
+	rules := rateLimitPolicies["log-in-by-email"]
+	want := map[string]RateLimitRule{
+		"ip":      {Key: "ip", Every: 6 * time.Second, Burst: 10},
+		"email":   {Key: "email", Every: 30 * time.Second, Burst: 5},
+		"session": {Key: "session", Every: time.Second, Burst: 2},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("rules = %v, want %v", rules, want)
+	}
+	for _, rule := range rules {
+		if rule != want[rule.Key] {
+			t.Errorf("rule = %v, want %v", rule, want[rule.Key])
+		}
+	}
+
+	for _, spec := range []string{"log-in-by-email", "log-in-by-email.ip=1s", "log-in-by-email.ip=soon/1", "log-in-by-email.cookie=1s/1"} {
+		if err := parseRateLimits(spec); err == nil {
+			t.Errorf("parseRateLimits(%q) succeeded", spec)
+		}
+	}
+}
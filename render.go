@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Bodies smaller than this aren't worth compressing.
+const minCompressSize = 1024
+
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	// Don't keep the odd huge page around.
+	if buf.Cap() <= 1<<20 {
+		bufferPool.Put(buf)
+	}
+}
+
+// writeHTML writes body, a fully rendered page, with status. Successful
+// pages get an ETag and are compressed when the client accepts it.
+//
+// Pages get no Last-Modified, so If-Modified-Since is ignored: they're
+// rendered from sessions, catalogs and many tables at once, and nothing
+// records when all of that last changed. A date we made up would let a
+// browser keep a stale page, where the ETag of the body can't. Static
+// files, which have a real build time, get both, see serveStaticAsset.
+func writeHTML(w http.ResponseWriter, r *http.Request, status int, body []byte, nonce string) {
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "private, no-cache")
+	h.Add("Vary", "Accept-Encoding")
+	h.Add("Vary", "Accept-Language")
+
+	if status == http.StatusOK {
+		// The CSP nonce changes every request, so it's left out of the
+		// ETag for unchanged pages to match.
+		tagged := body
+		if nonce != "" {
+			tagged = bytes.ReplaceAll(body, []byte(nonce), nil)
+		}
+		sum := sha256.Sum256(tagged)
+		etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+		h.Set("ETag", etag)
+
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			// The cached page carries the nonce of the cached policy,
+			// which sending a new policy would replace.
+			h.Del("Content-Security-Policy")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if len(body) >= minCompressSize {
+		br, gz := acceptedEncodings(r)
+		if br || gz {
+			compressed := getBuffer()
+			defer putBuffer(compressed)
+
+			if br {
+				h.Set("Content-Encoding", "br")
+				bw := brotli.NewWriterLevel(compressed, brotli.DefaultCompression)
+				bw.Write(body)
+				bw.Close()
+			} else {
+				h.Set("Content-Encoding", "gzip")
+				gw := gzip.NewWriter(compressed)
+				gw.Write(body)
+				gw.Close()
+			}
+			body = compressed.Bytes()
+		}
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch matches
+// etag, comparing weakly.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
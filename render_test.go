@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestETagMatches(t *testing.T) {
+	const etag = `W/"abc"`
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`W/"abd"`, false},
+		{`"xyz", W/"abc"`, true},
+		{`"xyz",W/"abc"`, true},
+		{`"xyz", "uvw"`, false},
+		{`*`, true},
+		{``, false},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, etag, got, tt.want)
+		}
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	page := []byte(`<script nonce="n1">` + strings.Repeat("台灣", minCompressSize) + `</script>`)
+	write := func(status int, body []byte, nonce string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header = header
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Security-Policy", "script-src 'nonce-"+nonce+"'")
+		writeHTML(w, r, status, body, nonce)
+		return w
+	}
+	etag := write(http.StatusOK, page, "n1", http.Header{}).Header().Get("ETag")
+
+	tests := []struct {
+		name     string
+		status   int
+		body     []byte
+		nonce    string
+		header   http.Header
+		want     int
+		wantETag bool
+		// wantEncoding is the Content-Encoding, and decode reads the body
+		// back.
+		wantEncoding string
+		decode       func(io.Reader) io.Reader
+	}{
+		{
+			name:     "uncompressed",
+			status:   http.StatusOK,
+			body:     page,
+			nonce:    "n1",
+			header:   http.Header{},
+			want:     http.StatusOK,
+			wantETag: true,
+		},
+		{
+			name:         "brotli preferred",
+			status:       http.StatusOK,
+			body:         page,
+			nonce:        "n1",
+			header:       http.Header{"Accept-Encoding": {"gzip, br"}},
+			want:         http.StatusOK,
+			wantETag:     true,
+			wantEncoding: "br",
+			decode:       func(r io.Reader) io.Reader { return brotli.NewReader(r) },
+		},
+		{
+			name:         "gzip",
+			status:       http.StatusOK,
+			body:         page,
+			nonce:        "n1",
+			header:       http.Header{"Accept-Encoding": {"gzip, br;q=0"}},
+			want:         http.StatusOK,
+			wantETag:     true,
+			wantEncoding: "gzip",
+			decode: func(r io.Reader) io.Reader {
+				gr, err := gzip.NewReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return gr
+			},
+		},
+		{
+			name:     "small pages aren't compressed",
+			status:   http.StatusOK,
+			body:     []byte("<p>hi</p>"),
+			header:   http.Header{"Accept-Encoding": {"br"}},
+			want:     http.StatusOK,
+			wantETag: true,
+		},
+		{
+			name:     "not modified",
+			status:   http.StatusOK,
+			body:     page,
+			nonce:    "n1",
+			header:   http.Header{"If-None-Match": {etag}},
+			want:     http.StatusNotModified,
+			wantETag: true,
+		},
+		{
+			name:     "not modified with a new nonce",
+			status:   http.StatusOK,
+			body:     bytes.ReplaceAll(page, []byte("n1"), []byte("n2")),
+			nonce:    "n2",
+			header:   http.Header{"If-None-Match": {etag}},
+			want:     http.StatusNotModified,
+			wantETag: true,
+		},
+		{
+			name:     "changed",
+			status:   http.StatusOK,
+			body:     append(page, "<p>new</p>"...),
+			nonce:    "n1",
+			header:   http.Header{"If-None-Match": {etag}},
+			want:     http.StatusOK,
+			wantETag: true,
+		},
+		{
+			name:   "errors aren't cached",
+			status: http.StatusNotFound,
+			body:   page,
+			nonce:  "n1",
+			header: http.Header{"If-None-Match": {etag}},
+			want:   http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := write(tt.status, tt.body, tt.nonce, tt.header)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("ETag"); (got != "") != tt.wantETag {
+				t.Errorf("ETag = %q, want one %v", got, tt.wantETag)
+			}
+
+			if w.Code == http.StatusNotModified {
+				if w.Body.Len() != 0 {
+					t.Error("304 has a body")
+				}
+				if w.Header().Get("Content-Security-Policy") != "" {
+					t.Error("304 replaces the cached page's policy")
+				}
+				return
+			}
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			var body io.Reader = w.Body
+			if tt.decode != nil {
+				body = tt.decode(body)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.body) {
+				t.Error("body doesn't round trip")
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errEmailSuppressed = errors.New("email address is suppressed")
+
+// snsHostPattern matches the hosts SNS serves signing certificates and
+// subscription URLs from.
+var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// sesTopicARN is the only SNS topic notifications are accepted from.
+// /ses-notifications/ isn't served without it, since any topic could
+// otherwise subscribe itself and suppress any address.
+var sesTopicARN string
+
+// snsMaxMessageAge is how old a message can be before it's taken for a
+// replay. SNS stops retrying deliveries well before that.
+const snsMaxMessageAge = time.Hour
+
+// snsHTTPClient fetches signing certificates and confirms subscriptions,
+// from within the public /ses-notifications/ handler.
+var snsHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// snsMaxCerts caps snsCerts. SNS signs with one certificate per region at a
+// time, so this is only reached by rotating through many of them.
+const snsMaxCerts = 16
+
+var (
+	snsCertsMu sync.Mutex
+	snsCerts   = map[string]*x509.Certificate{}
+)
+
+type SNSMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+}
+
+type SESNotification struct {
+	NotificationType string `json:"notificationType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BounceSubType     string `json:"bounceSubType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+		ComplainedRecipients  []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// verifySNSMessage checks msg was signed by SNS, following
+// https://docs.aws.amazon.com/sns/latest/dg/sns-verify-signature-of-message.html.
+func verifySNSMessage(ctx context.Context, msg *SNSMessage) error {
+	var fields []string
+	switch msg.Type {
+	case "Notification":
+		fields = []string{"Message", msg.Message, "MessageId", msg.MessageId}
+		if msg.Subject != "" {
+			fields = append(fields, "Subject", msg.Subject)
+		}
+		fields = append(fields, "Timestamp", msg.Timestamp, "TopicArn", msg.TopicArn, "Type", msg.Type)
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = []string{
+			"Message", msg.Message,
+			"MessageId", msg.MessageId,
+			"SubscribeURL", msg.SubscribeURL,
+			"Timestamp", msg.Timestamp,
+			"Token", msg.Token,
+			"TopicArn", msg.TopicArn,
+			"Type", msg.Type,
+		}
+	default:
+		return fmt.Errorf("unknown SNS message type %q", msg.Type)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, msg.Timestamp)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(timestamp); age > snsMaxMessageAge || age < -5*time.Minute {
+		return fmt.Errorf("SNS message timestamp %s is out of range", msg.Timestamp)
+	}
+
+	var b strings.Builder
+	for _, field := range fields {
+		b.WriteString(field)
+		b.WriteString("\n")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return err
+	}
+
+	cert, err := snsCertificate(ctx, msg.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("SNS signing certificate isn't RSA")
+	}
+
+	switch msg.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(b.String()))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA1, sum[:], signature)
+	case "2":
+		sum := sha256.Sum256([]byte(b.String()))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature)
+	}
+
+	return fmt.Errorf("unknown SNS signature version %q", msg.SignatureVersion)
+}
+
+// snsCertificate fetches and caches the certificate at certURL, which must
+// be served by SNS over HTTPS, until it expires.
+func snsCertificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || !snsHostPattern.MatchString(u.Host) || !strings.HasSuffix(u.Path, ".pem") {
+		return nil, fmt.Errorf("untrusted SNS signing certificate URL %q", certURL)
+	}
+
+	snsCertsMu.Lock()
+	cert, ok := snsCerts[certURL]
+	snsCertsMu.Unlock()
+	if ok && time.Now().Before(cert.NotAfter) {
+		return cert, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := snsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", certURL, res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("SNS signing certificate isn't PEM")
+	}
+	if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, err
+	}
+
+	snsCertsMu.Lock()
+	now := time.Now()
+	for u, c := range snsCerts {
+		if now.After(c.NotAfter) || len(snsCerts) >= snsMaxCerts {
+			delete(snsCerts, u)
+		}
+	}
+	snsCerts[certURL] = cert
+	snsCertsMu.Unlock()
+
+	return cert, nil
+}
+
+// confirmSNSSubscription visits the SubscribeURL of a verified
+// SubscriptionConfirmation.
+func confirmSNSSubscription(ctx context.Context, msg *SNSMessage) error {
+	u, err := url.Parse(msg.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || !snsHostPattern.MatchString(u.Host) {
+		return fmt.Errorf("untrusted SNS subscribe URL %q", msg.SubscribeURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, msg.SubscribeURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := snsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", msg.SubscribeURL, res.Status)
+	}
+
+	// The confirmation's XML isn't needed, only read enough of it to reuse
+	// the connection.
+	_, err = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	return err
+}
+
+// recordSESNotification adds hard bounced and complaining recipients to
+// email_suppressions. Soft bounces are left to the outbox's retries.
+func recordSESNotification(ctx context.Context, message string) error {
+	n := SESNotification{}
+	if err := json.Unmarshal([]byte(message), &n); err != nil {
+		return err
+	}
+
+	switch n.NotificationType {
+	case "Bounce":
+		if n.Bounce.BounceType != "Permanent" {
+			return nil
+		}
+		for _, recipient := range n.Bounce.BouncedRecipients {
+			detail := n.Bounce.BounceSubType
+			if recipient.DiagnosticCode != "" {
+				detail += ": " + recipient.DiagnosticCode
+			}
+			if err := suppressEmail(ctx, recipient.EmailAddress, "bounce", detail); err != nil {
+				return err
+			}
+		}
+	case "Complaint":
+		for _, recipient := range n.Complaint.ComplainedRecipients {
+			if err := suppressEmail(ctx, recipient.EmailAddress, "complaint", n.Complaint.ComplaintFeedbackType); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func suppressEmail(ctx context.Context, email string, reason string, detail string) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO email_suppressions (email, reason, detail)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO UPDATE SET
+		reason = excluded.reason,
+		detail = excluded.detail,
+		created_at = CURRENT_TIMESTAMP
+	`, strings.ToLower(email), reason, detail)
+	return err
+}
+
+// checkEmailSuppressed returns errEmailSuppressed if mail to email has
+// bounced or been reported as spam.
+func checkEmailSuppressed(ctx context.Context, email string) error {
+	var suppressed bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM email_suppressions WHERE email = ?)
+	`, strings.ToLower(email)).Scan(&suppressed); err != nil {
+		return err
+	}
+
+	if suppressed {
+		return errEmailSuppressed
+	}
+	return nil
+}
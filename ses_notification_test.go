@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newSNSTestCert makes a self-signed certificate valid until notAfter.
+func newSNSTestCert(t *testing.T, notAfter time.Time) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// roundTripFunc serves an http.Client's requests without a network.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestSNSCertificate(t *testing.T) {
+	_, fresh := newSNSTestCert(t, time.Now().Add(time.Hour))
+	_, expired := newSNSTestCert(t, time.Now().Add(-time.Minute))
+
+	fetches := 0
+	previous := snsHTTPClient
+	snsHTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		fetches++
+		body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fresh.Raw})
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body)), Request: r}, nil
+	})}
+	t.Cleanup(func() {
+		snsHTTPClient = previous
+		snsCertsMu.Lock()
+		clear(snsCerts)
+		snsCertsMu.Unlock()
+	})
+
+	const certURL = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-cache.pem"
+	tests := []struct {
+		name      string
+		cached    *x509.Certificate
+		wantFetch bool
+	}{
+		{"not cached", nil, true},
+		{"cached", fresh, false},
+		{"cached but expired", expired, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snsCertsMu.Lock()
+			clear(snsCerts)
+			if tt.cached != nil {
+				snsCerts[certURL] = tt.cached
+			}
+			snsCertsMu.Unlock()
+			fetches = 0
+
+			cert, err := snsCertificate(t.Context(), certURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cert.Equal(fresh) {
+				t.Error("got another certificate")
+			}
+			if (fetches > 0) != tt.wantFetch {
+				t.Errorf("fetched %d times, want a fetch %v", fetches, tt.wantFetch)
+			}
+		})
+	}
+
+	t.Run("capped", func(t *testing.T) {
+		for i := range snsMaxCerts * 2 {
+			if _, err := snsCertificate(t.Context(), fmt.Sprintf("https://sns.us-east-1.amazonaws.com/cert-%d.pem", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		snsCertsMu.Lock()
+		n := len(snsCerts)
+		snsCertsMu.Unlock()
+		if n > snsMaxCerts {
+			t.Errorf("caches %d certificates, want at most %d", n, snsMaxCerts)
+		}
+	})
+}
+
+func TestVerifySNSMessage(t *testing.T) {
+	key, cert := newSNSTestCert(t, time.Now().Add(time.Hour))
+
+	// The certificate is cached already, so nothing is fetched.
+	const certURL = "https://sns.ap-northeast-1.amazonaws.com/SimpleNotificationService-test.pem"
+	snsCertsMu.Lock()
+	snsCerts[certURL] = cert
+	snsCertsMu.Unlock()
+	t.Cleanup(func() {
+		snsCertsMu.Lock()
+		delete(snsCerts, certURL)
+		snsCertsMu.Unlock()
+	})
+
+	sign := func(msg *SNSMessage, signed string) {
+		var sig []byte
+		var err error
+		switch msg.SignatureVersion {
+		case "1":
+			sum := sha1.Sum([]byte(signed))
+			sig, err = rsa.SignPKCS1v15(crand.Reader, key, crypto.SHA1, sum[:])
+		default:
+			sum := sha256.Sum256([]byte(signed))
+			sig, err = rsa.SignPKCS1v15(crand.Reader, key, crypto.SHA256, sum[:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Signature = base64.StdEncoding.EncodeToString(sig)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	notification := func(version string) *SNSMessage {
+		return &SNSMessage{
+			Type:             "Notification",
+			MessageId:        "id",
+			TopicArn:         "arn:aws:sns:ap-northeast-1:123456789012:ses",
+			Message:          `{"notificationType":"Bounce"}`,
+			Timestamp:        now,
+			SignatureVersion: version,
+			SigningCertURL:   certURL,
+		}
+	}
+	// stringToSign is written out by hand from the AWS docs, so it checks
+	// the order verifySNSMessage puts the fields in.
+	stringToSign := func(msg *SNSMessage) string {
+		if msg.Type == "SubscriptionConfirmation" {
+			return "Message\n" + msg.Message + "\nMessageId\n" + msg.MessageId + "\nSubscribeURL\n" + msg.SubscribeURL +
+				"\nTimestamp\n" + msg.Timestamp + "\nToken\n" + msg.Token + "\nTopicArn\n" + msg.TopicArn + "\nType\n" + msg.Type + "\n"
+		}
+		s := "Message\n" + msg.Message + "\nMessageId\n" + msg.MessageId + "\n"
+		if msg.Subject != "" {
+			s += "Subject\n" + msg.Subject + "\n"
+		}
+		return s + "Timestamp\n" + msg.Timestamp + "\nTopicArn\n" + msg.TopicArn + "\nType\n" + msg.Type + "\n"
+	}
+
+	tests := []struct {
+		name string
+		msg  func() *SNSMessage
+		// tamper changes the message after it's signed.
+		tamper  func(msg *SNSMessage)
+		wantErr bool
+	}{
+		{
+			name: "signature version 1",
+			msg:  func() *SNSMessage { return notification("1") },
+		},
+		{
+			name: "signature version 2",
+			msg:  func() *SNSMessage { return notification("2") },
+		},
+		{
+			name: "with subject",
+			msg: func() *SNSMessage {
+				msg := notification("2")
+				msg.Subject = "Amazon SES Email Event Notification"
+				return msg
+			},
+		},
+		{
+			name: "subscription confirmation",
+			msg: func() *SNSMessage {
+				msg := notification("2")
+				msg.Type = "SubscriptionConfirmation"
+				msg.Token = "token"
+				msg.SubscribeURL = "https://sns.ap-northeast-1.amazonaws.com/?Action=ConfirmSubscription"
+				return msg
+			},
+		},
+		{
+			name:    "tampered message",
+			msg:     func() *SNSMessage { return notification("2") },
+			tamper:  func(msg *SNSMessage) { msg.Message = `{"notificationType":"Complaint"}` },
+			wantErr: true,
+		},
+		{
+			name:    "subject added",
+			msg:     func() *SNSMessage { return notification("2") },
+			tamper:  func(msg *SNSMessage) { msg.Subject = "subject" },
+			wantErr: true,
+		},
+		{
+			name:    "other version claimed",
+			msg:     func() *SNSMessage { return notification("1") },
+			tamper:  func(msg *SNSMessage) { msg.SignatureVersion = "2" },
+			wantErr: true,
+		},
+		{
+			name: "replayed",
+			msg: func() *SNSMessage {
+				msg := notification("2")
+				msg.Timestamp = time.Now().Add(-snsMaxMessageAge - time.Minute).UTC().Format(time.RFC3339)
+				return msg
+			},
+			wantErr: true,
+		},
+		{
+			name: "from the future",
+			msg: func() *SNSMessage {
+				msg := notification("2")
+				msg.Timestamp = time.Now().Add(10 * time.Minute).UTC().Format(time.RFC3339)
+				return msg
+			},
+			wantErr: true,
+		},
+		{
+			name: "bad timestamp",
+			msg: func() *SNSMessage {
+				msg := notification("2")
+				msg.Timestamp = "yesterday"
+				return msg
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown type",
+			msg: func() *SNSMessage {
+				msg := notification("2")
+				msg.Type = "Advertisement"
+				return msg
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown signature version",
+			msg:     func() *SNSMessage { return notification("3") },
+			wantErr: true,
+		},
+		{
+			name:    "untrusted certificate URL",
+			msg:     func() *SNSMessage { return notification("2") },
+			tamper:  func(msg *SNSMessage) { msg.SigningCertURL = "https://sns.example.com/cert.pem" },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg()
+			sign(msg, stringToSign(msg))
+			if tt.tamper != nil {
+				tt.tamper(msg)
+			}
+
+			err := verifySNSMessage(t.Context(), msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
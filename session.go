@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// sessionIdleTTL is how long a session survives without being used.
+	sessionIdleTTL = 7 * 24 * time.Hour
+	// sessionMaxTTL caps a session's lifetime however often it is used.
+	sessionMaxTTL = 90 * 24 * time.Hour
+	// sessionTouchInterval throttles last_seen_at writes.
+	sessionTouchInterval = time.Minute
+)
+
+type Session struct {
+	ID         int64
+	UserAgent  string
+	IP         string
+	CreatedAt  string
+	LastSeenAt string
+	Current    bool
+}
+
+// prepareSessionStmt prepares sessionStmt, which looks up the user of a
+// session on every request that needs one.
+func prepareSessionStmt() error {
+	var err error
+	sessionStmt, err = db.Prepare(`
+		SELECT
+		users.username,
+		COALESCE(email, ''),
+		COALESCE(locale, ''),
+		last_seen_at
+		FROM user_log_in_sessions
+		JOIN users ON user_log_in_sessions.username = users.username
+		WHERE token_hash = ?
+		AND expires_at > ?
+		LIMIT 1
+	`)
+	return err
+}
+
+// hashSessionID is what's stored in user_log_in_sessions, so reading the
+// database doesn't let anyone take over a session.
+func hashSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+func getSessionUser(r *http.Request) (*User, bool, error) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return nil, false, nil
+	}
+
+	now := time.Now().UTC()
+	tokenHash := hashSessionID(cookie.Value)
+
+	u := User{}
+	var lastSeenAt string
+	if err := sessionStmt.QueryRow(tokenHash, now.Format(time.DateTime)).Scan(&u.Username, &u.Email, &u.Locale, &lastSeenAt); errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	// Slide the expiry forward, at most once per sessionTouchInterval.
+	if seen, err := time.Parse(time.DateTime, lastSeenAt); err != nil || now.Sub(seen) > sessionTouchInterval {
+		if _, err := db.Exec(`
+			UPDATE user_log_in_sessions
+			SET last_seen_at = ?, expires_at = MIN(?, max_expires_at), ip = ?
+			WHERE token_hash = ?
+		`, now.Format(time.DateTime), now.Add(sessionIdleTTL).Format(time.DateTime), clientIP(r), tokenHash); err != nil {
+			slog.ErrorContext(r.Context(), "touch session failed", "err", err)
+		}
+	}
+
+	return &u, true, nil
+}
+
+// startSession creates a log in session for username on the device making
+// r and sets the session cookie on w.
+func startSession(w http.ResponseWriter, r *http.Request, username string) error {
+	bs := make([]byte, 32)
+	if _, err := crand.Read(bs); err != nil {
+		return err
+	}
+	sessionId := base64.URLEncoding.EncodeToString(bs)
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.Exec(`
+		INSERT INTO user_log_in_sessions (token_hash, username, user_agent, ip, expires_at, max_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hashSessionID(sessionId), username, userAgent, clientIP(r), now.Add(sessionIdleTTL).Format(time.DateTime), now.Add(sessionMaxTTL).Format(time.DateTime)); err != nil {
+		return err
+	}
+
+	cookie := http.Cookie{
+		Name:  "session",
+		Value: sessionId,
+		Path:  "/", Expires: now.Add(sessionMaxTTL),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// endSession deletes the session of the device making r and clears its
+// cookie. Other devices stay logged in.
+func endSession(w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return nil
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	_, err = db.Exec("DELETE FROM user_log_in_sessions WHERE token_hash = ?", hashSessionID(cookie.Value))
+	return err
+}
+
+func listSessions(ctx context.Context, r *http.Request, username string) ([]Session, error) {
+	currentHash := ""
+	if cookie, err := r.Cookie("session"); err == nil {
+		currentHash = hashSessionID(cookie.Value)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, token_hash, user_agent, ip, created_at, last_seen_at
+		FROM user_log_in_sessions
+		WHERE username = ? AND expires_at > ?
+		ORDER BY last_seen_at DESC
+	`, username, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var tokenHash string
+		s := Session{}
+		if err := rows.Scan(&s.ID, &tokenHash, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			return nil, err
+		}
+		s.Current = tokenHash == currentHash
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func revokeSession(ctx context.Context, username string, id int64) (bool, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM user_log_in_sessions WHERE id = ? AND username = ?", id, username)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func revokeAllSessions(ctx context.Context, username string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM user_log_in_sessions WHERE username = ?", username)
+	return err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// StaticAsset is a file under static/, minified and compressed once at
+// startup.
+type StaticAsset struct {
+	Name        string
+	HashedName  string
+	ContentType string
+	ETag        string
+	// Integrity is the SRI hash of Body.
+	Integrity string
+	Body      []byte
+	Gzip      []byte
+	Brotli    []byte
+}
+
+var (
+	staticAssetsMu sync.RWMutex
+	// staticAssets has every asset under both its name and hashed name.
+	staticAssets = map[string]*StaticAsset{}
+	// staticModTime is when the assets were built, for Last-Modified.
+	staticModTime time.Time
+)
+
+// loadStaticAssets fingerprints, minifies and precompresses the files under
+// static/ in assetFS and swaps them in.
+func loadStaticAssets() error {
+	assets := map[string]*StaticAsset{}
+	err := fs.WalkDir(assetFS, "static", func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		body, err := fs.ReadFile(assetFS, file)
+		if err != nil {
+			return err
+		}
+		asset, err := newStaticAsset(strings.TrimPrefix(file, "static/"), body)
+		if err != nil {
+			return err
+		}
+		assets[asset.Name] = asset
+		assets[asset.HashedName] = asset
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	staticAssetsMu.Lock()
+	staticAssets, staticModTime = assets, time.Now().UTC()
+	staticAssetsMu.Unlock()
+
+	return nil
+}
+
+func newStaticAsset(name string, body []byte) (*StaticAsset, error) {
+	ext := path.Ext(name)
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Minifying only applies to types with a minifier registered.
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if _, _, f := minifier.Match(mediaType); f != nil {
+		minified, err := minifier.Bytes(mediaType, body)
+		if err != nil {
+			return nil, err
+		}
+		body = minified
+	}
+
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])[:12]
+
+	asset := &StaticAsset{
+		Name:        name,
+		HashedName:  strings.TrimSuffix(name, ext) + "." + hash + ext,
+		ContentType: contentType,
+		ETag:        `"` + hash + `"`,
+		Integrity:   subresourceIntegrity("sha384", body),
+		Body:        body,
+	}
+
+	if compressible(mediaType) {
+		var gz bytes.Buffer
+		gzipWriter, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+		gzipWriter.Write(body)
+		if err := gzipWriter.Close(); err != nil {
+			return nil, err
+		}
+		if gz.Len() < len(body) {
+			asset.Gzip = gz.Bytes()
+		}
+
+		// The best brotli level takes seconds on large vendored files.
+		level := brotli.BestCompression
+		if len(body) > 1<<20 {
+			level = brotli.DefaultCompression
+		}
+		var br bytes.Buffer
+		brotliWriter := brotli.NewWriterLevel(&br, level)
+		brotliWriter.Write(body)
+		if err := brotliWriter.Close(); err != nil {
+			return nil, err
+		}
+		if br.Len() < len(body) {
+			asset.Brotli = br.Bytes()
+		}
+	}
+
+	return asset, nil
+}
+
+func compressible(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/json" ||
+		mediaType == "application/javascript"
+}
+
+// assetURL is the "asset" template func. It resolves name under static/ to
+// its hashed URL, which can be cached forever.
+func assetURL(name string) string {
+	staticAssetsMu.RLock()
+	asset, ok := staticAssets[name]
+	staticAssetsMu.RUnlock()
+	if !ok {
+		slog.Warn("unknown static asset", "name", name)
+		return "/static/" + name
+	}
+
+	return "/static/" + asset.HashedName
+}
+
+// serveStaticAsset serves /static/{name...}. Hashed names are immutable;
+// plain names still work but are revalidated every time.
+func serveStaticAsset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	staticAssetsMu.RLock()
+	asset, ok := staticAssets[name]
+	modTime := staticModTime
+	staticAssetsMu.RUnlock()
+	if !ok {
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if name == asset.HashedName {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", asset.ContentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Each encoding is a different representation and gets its own ETag.
+	body, etag := asset.Body, asset.ETag
+	br, gz := acceptedEncodings(r)
+	switch {
+	case br && asset.Brotli != nil:
+		w.Header().Set("Content-Encoding", "br")
+		body, etag = asset.Brotli, strings.TrimSuffix(etag, `"`)+`-br"`
+	case gz && asset.Gzip != nil:
+		w.Header().Set("Content-Encoding", "gzip")
+		body, etag = asset.Gzip, strings.TrimSuffix(etag, `"`)+`-gz"`
+	}
+	w.Header().Set("ETag", etag)
+
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
+
+// acceptedEncodings reports whether r accepts brotli and gzip.
+func acceptedEncodings(r *http.Request) (br bool, gz bool) {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "br":
+			br = true
+		case "gzip":
+			gz = true
+		}
+	}
+	return br, gz
+}
@@ -0,0 +1,85 @@
+const decode = (value) =>
+  Uint8Array.from(
+    atob(value.replace(/-/g, "+").replace(/_/g, "/")),
+    (c) => c.charCodeAt(0),
+  ).buffer;
+
+const encode = (buffer) =>
+  btoa(String.fromCharCode(...new Uint8Array(buffer)))
+    .replace(/\+/g, "-")
+    .replace(/\//g, "_")
+    .replace(/=+$/, "");
+
+const post = async (url, body) => {
+  const headers = {
+    "X-CSRF-Token": document.querySelector('meta[name="csrf-token"]').content,
+  };
+  if (body) {
+    headers["Content-Type"] = "application/json";
+  }
+
+  const res = await fetch(url, {
+    method: "POST",
+    headers,
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  if (!res.ok) {
+    throw new Error(`${url}: ${res.status}`);
+  }
+  return res;
+};
+
+export async function registerPasskey(name) {
+  const { publicKey } = await (
+    await post("/passkeys/register/begin/")
+  ).json();
+
+  publicKey.challenge = decode(publicKey.challenge);
+  publicKey.user.id = decode(publicKey.user.id);
+  publicKey.excludeCredentials = (publicKey.excludeCredentials ?? []).map(
+    (c) => ({ ...c, id: decode(c.id) }),
+  );
+
+  const credential = await navigator.credentials.create({ publicKey });
+
+  await post(
+    `/passkeys/register/finish/?name=${encodeURIComponent(name)}`,
+    {
+      id: credential.id,
+      rawId: encode(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: encode(credential.response.clientDataJSON),
+        attestationObject: encode(credential.response.attestationObject),
+        transports: credential.response.getTransports?.() ?? [],
+      },
+    },
+  );
+}
+
+export async function logInWithPasskey() {
+  const { publicKey } = await (
+    await post("/log-in-by-passkey/begin/")
+  ).json();
+
+  publicKey.challenge = decode(publicKey.challenge);
+  publicKey.allowCredentials = (publicKey.allowCredentials ?? []).map(
+    (c) => ({ ...c, id: decode(c.id) }),
+  );
+
+  const credential = await navigator.credentials.get({ publicKey });
+
+  await post("/log-in-by-passkey/finish/", {
+    id: credential.id,
+    rawId: encode(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: encode(credential.response.clientDataJSON),
+      authenticatorData: encode(credential.response.authenticatorData),
+      signature: encode(credential.response.signature),
+      userHandle: credential.response.userHandle
+        ? encode(credential.response.userHandle)
+        : undefined,
+    },
+  });
+}
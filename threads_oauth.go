@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ThreadsOAuthClient exchanges Threads authorization codes for access
+// tokens. The endpoints are configurable so a local stub can stand in for
+// graph.threads.net.
+type ThreadsOAuthClient struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	AuthorizeURL string
+	TokenURL     string
+	GraphURL     string
+	HTTPClient   *http.Client
+}
+
+type ThreadsToken struct {
+	AccessToken string      `json:"access_token"`
+	UserID      json.Number `json:"user_id"`
+}
+
+func (c *ThreadsOAuthClient) AuthCodeURL(state string) string {
+	return c.AuthorizeURL + "?" + url.Values{
+		"client_id":     {c.ClientID},
+		"redirect_uri":  {c.RedirectURI},
+		"scope":         {"threads_basic"},
+		"response_type": {"code"},
+		"state":         {state},
+	}.Encode()
+}
+
+func (c *ThreadsOAuthClient) Exchange(ctx context.Context, code string) (*ThreadsToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(url.Values{
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {c.RedirectURI},
+		"code":          {code},
+	}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	token := ThreadsToken{}
+	if err := c.doJSON(req, &token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" || token.UserID == "" {
+		return nil, errors.New("threads token response is missing access_token or user_id")
+	}
+
+	return &token, nil
+}
+
+// Username returns the Threads username of the token owner.
+func (c *ThreadsOAuthClient) Username(ctx context.Context, accessToken string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.GraphURL+"/me?"+url.Values{
+		"fields":       {"id,username"},
+		"access_token": {accessToken},
+	}.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := c.doJSON(req, &me); err != nil {
+		return "", err
+	}
+
+	return me.Username, nil
+}
+
+func (c *ThreadsOAuthClient) doJSON(req *http.Request, v any) error {
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, res.Status, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// tokenCipher encrypts third-party tokens before they are written to the
+// database. It is nil when TOKEN_ENCRYPTION_KEY is not set.
+var tokenCipher cipher.AEAD
+
+func newTokenCipher(encodedKey string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("TOKEN_ENCRYPTION_KEY must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encryptToken(plaintext string) ([]byte, error) {
+	if tokenCipher == nil {
+		return nil, errors.New("token encryption is not configured")
+	}
+
+	nonce := make([]byte, tokenCipher.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return tokenCipher.Seal(nonce, nonce, []byte(plaintext), nil), nil
+}
+
+// setThreadsStateCookie binds the OAuth state to the browser that started
+// the flow. An empty state clears the cookie.
+func setThreadsStateCookie(w http.ResponseWriter, state string) {
+	cookie := http.Cookie{
+		Name:     "threads_state",
+		Value:    state,
+		Path:     "/threads-auth/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, &cookie)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// usernamePattern matches the pattern attribute of username inputs, and
+// the length of users.username.
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,32}$`)
+
+// reservedUsernames can't be taken by anyone, so they can't be mistaken for
+// staff or for our own pages. They're compared case-insensitively.
+var reservedUsernames = map[string]bool{
+	"account":       true,
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"dev":           true,
+	"help":          true,
+	"log-in":        true,
+	"log-out":       true,
+	"mod":           true,
+	"moderator":     true,
+	"no-reply":      true,
+	"noreply":       true,
+	"passkeys":      true,
+	"root":          true,
+	"sign-up":       true,
+	"static":        true,
+	"support":       true,
+	"system":        true,
+	"xrpc":          true,
+}
+
+// FieldErrors maps form field names to the catalog key of the message shown
+// under them.
+type FieldErrors map[string]string
+
+// Form is what form templates are rendered with: the submitted values, so
+// the user doesn't have to type them again, and any errors.
+type Form struct {
+	Values url.Values
+	Errors FieldErrors
+}
+
+func validateUsername(username string) string {
+	if !usernamePattern.MatchString(username) {
+		return "form.username-invalid"
+	}
+	if reservedUsernames[strings.ToLower(username)] {
+		return "form.username-reserved"
+	}
+	return ""
+}
+
+// normalizeEmail trims and lowercases email and checks it's a bare
+// address. It returns the normalized address and an error message key.
+func normalizeEmail(email string) (string, string) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email || len(email) > 254 {
+		return email, "form.email-invalid"
+	}
+
+	return email, ""
+}
+
+// writeFormErrors re-renders the form template name with form's errors in
+// place of the element with id target.
+func writeFormErrors(w http.ResponseWriter, r *http.Request, target string, name string, form Form) {
+	w.Header().Set("HX-Retarget", "#"+target)
+	w.Header().Set("HX-Reswap", "outerHTML")
+	executeTemplatesStatus(w, r, http.StatusUnprocessableEntity, form, "", name)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VendorFile is a third-party file served from /static/vendor/ instead of
+// a CDN. `app vendor` downloads URL into static/vendor/Name and checks it
+// against Integrity, the SRI hash of the pinned upstream file. ES modules
+// set Import, the bare specifier pages import them by.
+type VendorFile struct {
+	Name      string
+	URL       string
+	Integrity string
+	Import    string
+}
+
+// d3 and Babylon aren't pinned yet, so `app vendor` refuses them with the
+// hash it downloaded until it's checked against upstream and added here.
+// The server starts without them, see checkVendorFiles.
+var vendorFiles = []VendorFile{
+	{
+		Name:      "htmx.min.js",
+		URL:       "https://unpkg.com/htmx.org@2.0.2/dist/htmx.min.js",
+		Integrity: "sha384-Y7hw+L/jvKeWIRRkqWYfPcvVxHzVzn5REgzbawhxAuQGwX1XWe70vji+VSeHOThJ",
+	},
+	{
+		Name:      "modern-normalize.min.css",
+		URL:       "https://cdnjs.cloudflare.com/ajax/libs/modern-normalize/3.0.1/modern-normalize.min.css",
+		Integrity: "sha512-q6WgHqiHlKyOqslT/lgBgodhd03Wp4BEqKeW6nNtlOY4quzyG3VoQKFrieaCeSnuVseNKRGpGeDU3qPmabCANg==",
+	},
+	{
+		Name: "d3.min.js",
+		URL:  "https://cdn.jsdelivr.net/npm/d3@7.9.0/dist/d3.min.js",
+	},
+	{
+		Name:   "babylonjs-core.js",
+		URL:    "https://cdn.jsdelivr.net/npm/@babylonjs/core@7.0.0/+esm",
+		Import: "@babylonjs/core",
+	},
+	{
+		Name:   "babylonjs-materials.js",
+		URL:    "https://cdn.jsdelivr.net/npm/@babylonjs/materials@7.0.0/+esm",
+		Import: "@babylonjs/materials",
+	},
+}
+
+// VendorAsset is what the "vendor" template func resolves a vendored file
+// to.
+type VendorAsset struct {
+	URL       string
+	Integrity string
+}
+
+// vendorAsset resolves the vendored file name to its hashed URL and the SRI
+// hash of what we serve, or nil if it hasn't been fetched, which pages
+// render without.
+func vendorAsset(name string) *VendorAsset {
+	staticAssetsMu.RLock()
+	asset, ok := staticAssets["vendor/"+name]
+	staticAssetsMu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	return &VendorAsset{URL: "/static/" + asset.HashedName, Integrity: asset.Integrity}
+}
+
+// checkVendorFiles warns about vendored files that are missing from assetFS
+// or have no pinned Integrity yet; pages load without them. A file that
+// doesn't match its pin isn't the file we reviewed, so that's an error.
+func checkVendorFiles() error {
+	var errs []error
+	for _, file := range vendorFiles {
+		data, err := fs.ReadFile(assetFS, "static/vendor/"+file.Name)
+		if err != nil {
+			slog.Warn("vendored file is missing, run `app vendor` to fetch it", "file", file.Name, "err", err)
+			continue
+		}
+		if file.Integrity == "" {
+			slog.Warn("vendored file has no pinned integrity", "file", file.Name, "integrity", subresourceIntegrity("sha384", data))
+			continue
+		}
+		if err := checkVendorIntegrity(file, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkVendorIntegrity reports whether data is the pinned upstream file.
+func checkVendorIntegrity(file VendorFile, data []byte) error {
+	if file.Integrity == "" {
+		return fmt.Errorf("%s: no pinned integrity, it is %s", file.Name, subresourceIntegrity("sha384", data))
+	}
+	algorithm, _, _ := strings.Cut(file.Integrity, "-")
+	if got := subresourceIntegrity(algorithm, data); got != file.Integrity {
+		return fmt.Errorf("%s: integrity is %s, expected %s", file.Name, got, file.Integrity)
+	}
+	return nil
+}
+
+// importMap is the "importMap" template func. It maps the plain URL of
+// every first-party module under /static/, and the specifier of every
+// vendored one, to its hashed URL, and gives each one an SRI hash, so
+// modules are cached forever and checked when loaded.
+func importMap() (template.HTML, error) {
+	imports := map[string]string{}
+	integrity := map[string]string{}
+
+	staticAssetsMu.RLock()
+	for name, asset := range staticAssets {
+		if name != asset.Name || path.Ext(name) != ".js" || strings.HasPrefix(name, "vendor/") {
+			continue
+		}
+		imports["/static/"+asset.Name] = "/static/" + asset.HashedName
+		integrity["/static/"+asset.HashedName] = asset.Integrity
+	}
+	for _, file := range vendorFiles {
+		asset, ok := staticAssets["vendor/"+file.Name]
+		if file.Import == "" || !ok {
+			continue
+		}
+		imports[file.Import] = "/static/" + asset.HashedName
+		integrity["/static/"+asset.HashedName] = asset.Integrity
+	}
+	staticAssetsMu.RUnlock()
+
+	// json.Marshal escapes <, > and &, so this can't close the script.
+	data, err := json.Marshal(map[string]any{"imports": imports, "integrity": integrity})
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(data), nil
+}
+
+// runVendorCommand implements the vendor subcommand, which downloads every
+// vendored file into static/vendor/. Files that don't match their pinned
+// Integrity aren't written; one without a pin fails with the hash of what
+// was downloaded, to be checked against upstream and pinned.
+func runVendorCommand(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Join("static", "vendor"), 0755); err != nil {
+		return err
+	}
+
+	for _, file := range vendorFiles {
+		data, err := fetchVendorFile(ctx, file.URL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+
+		if err := checkVendorIntegrity(file, data); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(filepath.Join("static", "vendor", file.Name), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fetchVendorFile(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, 32<<20))
+}
+
+// subresourceIntegrity returns the SRI hash of data, algorithm being one of
+// "sha256", "sha384" or "sha512".
+func subresourceIntegrity(algorithm string, data []byte) string {
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		algorithm, h = "sha384", sha512.New384()
+	}
+	h.Write(data)
+
+	return algorithm + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}